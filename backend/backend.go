@@ -0,0 +1,275 @@
+// Package backend implements a LibreSpeed compatible speed test server, serving the endpoints
+// a defs.Server is tested against
+package backend
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/czechbol/librespeedtest/defs"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultChunkSize is the default size of a chunk of the download payload, in bytes
+	DefaultChunkSize = 1024 * 1024
+	// DefaultChunks is the number of chunks sent when a download request doesn't ask for any
+	DefaultChunks = 4
+	// DefaultMaxChunks is the default limit of the chunks a single download request gets
+	DefaultMaxChunks = 1024
+	// DefaultMaxTelemetrySize is the limit of the size of a form posted to the telemetry endpoint, in bytes.
+	// The uploads of the speed test go to the empty endpoint, which doesn't limit them
+	DefaultMaxTelemetrySize = 1024 * 1024
+)
+
+// Config holds the parameters of the backend
+type Config struct {
+	// ChunkSize is the size of a chunk of the download payload in bytes, DefaultChunkSize is used when zero
+	ChunkSize int
+	// MaxChunks limits the chunks a single download request gets, DefaultMaxChunks is used when zero
+	MaxChunks int
+	// RateLimit is the number of requests per second a single client may make, zero disables the limit
+	RateLimit float64
+	// RateBurst is the number of requests a client may make at once, the rate limit rounded up is
+	// used when zero
+	RateBurst int
+	// TrustProxy takes the client's address from the X-Real-IP and X-Forwarded-For headers
+	TrustProxy bool
+	// Geo looks up the ISP info returned by getIP, the address alone is returned when nil
+	Geo defs.GeoProvider
+	// Location is the server's location as "latitude,longitude", getIP tells the client's
+	// distance from it when set
+	Location string
+	// Results stores the results posted to the telemetry endpoint and backs their share pages
+	// and the JSON listing, all of them are disabled when nil
+	Results ResultStore
+	// ResultsToken is the token the JSON listing of the results requires, as a bearer token or
+	// with ?token=, the listing is disabled when empty
+	ResultsToken string
+}
+
+// Server serves the garbage, empty, getIP and telemetry endpoints of a LibreSpeed backend,
+// along with the share pages of the results
+type Server struct {
+	config  Config
+	chunk   []byte
+	limiter *rateLimiter
+	mux     *http.ServeMux
+}
+
+// New creates a backend with the given configuration
+func New(config Config) (*Server, error) {
+	if config.ChunkSize <= 0 {
+		config.ChunkSize = DefaultChunkSize
+	}
+	if config.MaxChunks <= 0 {
+		config.MaxChunks = DefaultMaxChunks
+	}
+
+	s := &Server{config: config, chunk: make([]byte, config.ChunkSize), mux: http.NewServeMux()}
+	// random data doesn't compress on the way
+	if _, err := rand.Read(s.chunk); err != nil {
+		return nil, err
+	}
+	if config.RateLimit > 0 {
+		s.limiter = newRateLimiter(config.RateLimit, config.RateBurst)
+	}
+
+	// the paths of the PHP backend and of the Go one
+	for _, prefix := range []string{"/", "/backend/"} {
+		s.mux.HandleFunc(prefix+"garbage.php", s.garbage)
+		s.mux.HandleFunc(prefix+"garbage", s.garbage)
+		s.mux.HandleFunc(prefix+"empty.php", s.empty)
+		s.mux.HandleFunc(prefix+"empty", s.empty)
+		s.mux.HandleFunc(prefix+"getIP.php", s.getIP)
+		s.mux.HandleFunc(prefix+"getIP", s.getIP)
+	}
+	if config.Results != nil {
+		s.mux.HandleFunc("/results/telemetry.php", s.telemetry)
+		s.mux.HandleFunc("/results/telemetry", s.telemetry)
+		s.mux.HandleFunc("/results/", s.sharePage)
+		if config.ResultsToken != "" {
+			s.mux.HandleFunc("/results/json", s.resultsJSON)
+		}
+	}
+	return s, nil
+}
+
+// Handle registers an extra handler on the backend, such as a results page
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Encoding, Content-Type")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	if s.limiter != nil {
+		if wait, ok := s.limiter.allow(s.clientIP(r), time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves the backend on addr until ctx is done, over TLS when certFile and keyFile are set
+func (s *Server) ListenAndServe(ctx context.Context, addr string, certFile string, keyFile string) error {
+	srv := &http.Server{Addr: addr, Handler: s, ReadHeaderTimeout: 10 * time.Second}
+
+	errc := make(chan error, 1)
+	go func() {
+		if certFile != "" || keyFile != "" {
+			errc <- srv.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			errc <- srv.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			return err
+		}
+		if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	}
+}
+
+// garbage sends ckSize chunks of random data
+func (s *Server) garbage(w http.ResponseWriter, r *http.Request) {
+	chunks := DefaultChunks
+	if ckSize := r.URL.Query().Get("ckSize"); ckSize != "" {
+		n, err := strconv.Atoi(ckSize)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid ckSize", http.StatusBadRequest)
+			return
+		}
+		chunks = n
+	}
+	if chunks > s.config.MaxChunks {
+		chunks = s.config.MaxChunks
+	}
+
+	w.Header().Set("Content-Description", "File Transfer")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename=random.dat")
+	w.Header().Set("Content-Transfer-Encoding", "binary")
+	w.Header().Set("Content-Length", strconv.Itoa(chunks*len(s.chunk)))
+	setNoCache(w)
+
+	for i := 0; i < chunks; i++ {
+		if _, err := w.Write(s.chunk); err != nil {
+			// the client stops reading once its test time is up
+			return
+		}
+	}
+}
+
+// empty discards the request body, the client measures the upload and the latency with it
+func (s *Server) empty(w http.ResponseWriter, r *http.Request) {
+	if _, err := io.Copy(io.Discard, r.Body); err != nil {
+		log.Debugf("Failed when reading the upload: %s", err)
+	}
+	setNoCache(w)
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+}
+
+// getIP tells the client its address, with the ISP info when asked for with isp=true
+func (s *Server) getIP(w http.ResponseWriter, r *http.Request) {
+	ip := s.clientIP(r)
+	result := defs.GetIPResult{ProcessedString: ip}
+	result.RawISPInfo.IP = ip
+
+	if special := describeSpecialIP(ip); special != "" {
+		result.ProcessedString = ip + " - " + special
+	} else if r.URL.Query().Get("isp") == "true" && s.config.Geo != nil {
+		info, err := s.config.Geo.Lookup(r.Context(), ip)
+		if err != nil {
+			log.Debugf("Failed to look up %s: %s", ip, err)
+		} else {
+			result.RawISPInfo = info.Merge(result.RawISPInfo)
+			result.ProcessedString = s.processedString(result.RawISPInfo, r.URL.Query().Get("distance"))
+		}
+	}
+
+	setNoCache(w)
+	writeJSON(w, result)
+}
+
+// processedString formats the client's ISP info the way the PHP backend does
+func (s *Server) processedString(info defs.IPInfoResponse, unit string) string {
+	processed := info.IP
+	if info.Organization != "" {
+		processed += " - " + info.Organization
+	}
+	if info.Country != "" {
+		processed += ", " + info.Country
+	}
+	if unit == "km" || unit == "mi" || unit == "NM" {
+		if km, err := defs.DistanceKm(info.Location, s.config.Location); err == nil {
+			processed += fmt.Sprintf(" (%.0f %s)", defs.ConvertDistance(km, unit), unit)
+		}
+	}
+	return processed
+}
+
+// clientIP returns the address the request came from
+func (s *Server) clientIP(r *http.Request) string {
+	if s.config.TrustProxy {
+		if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+			return ip
+		}
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// describeSpecialIP names the addresses no ISP info exists for, like the PHP backend does
+func describeSpecialIP(ip string) string {
+	addr := net.ParseIP(ip)
+	switch {
+	case addr == nil:
+		return ""
+	case addr.IsLoopback():
+		return "localhost access"
+	case addr.IsPrivate():
+		return "private network access"
+	case addr.IsLinkLocalUnicast():
+		return "link-local access"
+	}
+	return ""
+}
+
+func setNoCache(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0, s-maxage=0")
+	w.Header().Add("Cache-Control", "post-check=0, pre-check=0")
+	w.Header().Set("Pragma", "no-cache")
+}
@@ -0,0 +1,173 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/czechbol/librespeedtest/defs"
+)
+
+// newTestBackend creates a backend with small download chunks
+func newTestBackend(t *testing.T, config Config) *Server {
+	t.Helper()
+	if config.ChunkSize == 0 {
+		config.ChunkSize = 16
+	}
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// serve sends the request to the backend and returns the recorded reply
+func serve(s *Server, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestGarbage(t *testing.T) {
+	s := newTestBackend(t, Config{MaxChunks: 8})
+
+	tests := []struct {
+		target string
+		status int
+		length int
+	}{
+		{"/garbage.php", http.StatusOK, DefaultChunks * 16},
+		{"/backend/garbage?ckSize=2", http.StatusOK, 2 * 16},
+		{"/garbage.php?ckSize=100", http.StatusOK, 8 * 16},
+		{"/garbage.php?ckSize=0", http.StatusBadRequest, -1},
+		{"/garbage.php?ckSize=x", http.StatusBadRequest, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			w := serve(s, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if w.Code != tt.status {
+				t.Fatalf("got status %d, want %d", w.Code, tt.status)
+			}
+			if tt.length >= 0 && w.Body.Len() != tt.length {
+				t.Errorf("got %d bytes, want %d", w.Body.Len(), tt.length)
+			}
+		})
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	s := newTestBackend(t, Config{})
+
+	for _, target := range []string{"/empty.php", "/backend/empty"} {
+		w := serve(s, httptest.NewRequest(http.MethodPost, target, strings.NewReader("upload")))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got status %d, want %d", target, w.Code, http.StatusOK)
+		}
+		if w.Header().Get("Access-Control-Allow-Origin") != "*" {
+			t.Errorf("%s: CORS headers are missing", target)
+		}
+	}
+
+	w := serve(s, httptest.NewRequest(http.MethodOptions, "/empty.php", nil))
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("preflight got status %d and %d bytes", w.Code, w.Body.Len())
+	}
+}
+
+// staticGeo looks up the same info for every address
+type staticGeo defs.IPInfoResponse
+
+func (g staticGeo) Lookup(ctx context.Context, ip string) (*defs.IPInfoResponse, error) {
+	info := defs.IPInfoResponse(g)
+	return &info, nil
+}
+
+func TestGetIP(t *testing.T) {
+	geo := staticGeo{Organization: "AS64500 Example", Country: "CZ", Location: "50.0,15.0"}
+
+	tests := []struct {
+		name       string
+		config     Config
+		remoteAddr string
+		header     http.Header
+		target     string
+		want       string
+	}{
+		{"plain", Config{}, "203.0.113.7:1234", nil, "/getIP.php", "203.0.113.7"},
+		{"loopback", Config{}, "127.0.0.1:1234", nil, "/getIP.php", "127.0.0.1 - localhost access"},
+		{"private", Config{}, "10.1.2.3:1234", nil, "/getIP", "10.1.2.3 - private network access"},
+		{"isp not asked for", Config{Geo: geo}, "203.0.113.7:1234", nil, "/getIP.php", "203.0.113.7"},
+		{"isp", Config{Geo: geo}, "203.0.113.7:1234", nil, "/getIP.php?isp=true", "203.0.113.7 - AS64500 Example, CZ"},
+		{
+			"isp with distance",
+			Config{Geo: geo, Location: "50.0,14.0"},
+			"203.0.113.7:1234",
+			nil,
+			"/getIP.php?isp=true&distance=km",
+			"203.0.113.7 - AS64500 Example, CZ (71 km)",
+		},
+		{
+			"unknown distance unit",
+			Config{Geo: geo, Location: "50.0,14.0"},
+			"203.0.113.7:1234",
+			nil,
+			"/getIP.php?isp=true&distance=ly",
+			"203.0.113.7 - AS64500 Example, CZ",
+		},
+		{
+			"untrusted proxy header",
+			Config{},
+			"203.0.113.7:1234",
+			http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			"/getIP.php",
+			"203.0.113.7",
+		},
+		{
+			"trusted proxy header",
+			Config{TrustProxy: true},
+			"10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"198.51.100.1, 10.0.0.2"}},
+			"/getIP.php",
+			"198.51.100.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestBackend(t, tt.config)
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			r.RemoteAddr = tt.remoteAddr
+			for key, values := range tt.header {
+				r.Header[key] = values
+			}
+
+			var result defs.GetIPResult
+			if err := json.NewDecoder(serve(s, r).Body).Decode(&result); err != nil {
+				t.Fatal(err)
+			}
+			if result.ProcessedString != tt.want {
+				t.Errorf("got %q, want %q", result.ProcessedString, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	s := newTestBackend(t, Config{RateLimit: 1, RateBurst: 2})
+
+	request := func(remoteAddr string) int {
+		r := httptest.NewRequest(http.MethodGet, "/empty.php", nil)
+		r.RemoteAddr = remoteAddr
+		return serve(s, r).Code
+	}
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if got := request("203.0.113.7:1234"); got != want {
+			t.Errorf("request %d got status %d, want %d", i, got, want)
+		}
+	}
+	if got := request("203.0.113.8:1234"); got != http.StatusOK {
+		t.Errorf("another client got status %d, want %d", got, http.StatusOK)
+	}
+}
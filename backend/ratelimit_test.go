@@ -0,0 +1,62 @@
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name     string
+		rate     float64
+		burst    int
+		requests []time.Duration
+		allowed  []bool
+	}{
+		{"burst", 1, 3, []time.Duration{0, 0, 0, 0}, []bool{true, true, true, false}},
+		{"refill", 2, 1, []time.Duration{0, 0, 500 * time.Millisecond, 600 * time.Millisecond}, []bool{true, false, true, false}},
+		{"default burst", 2.5, 0, []time.Duration{0, 0, 0, 0}, []bool{true, true, true, false}},
+		{"refill is capped by the burst", 10, 2, []time.Duration{0, time.Hour, time.Hour, time.Hour}, []bool{true, true, true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRateLimiter(tt.rate, tt.burst)
+			for i, offset := range tt.requests {
+				if _, ok := l.allow("client", start.Add(offset)); ok != tt.allowed[i] {
+					t.Errorf("request %d allowed %v, want %v", i, ok, tt.allowed[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := newRateLimiter(4, 1)
+	l.allow("client", now)
+
+	wait, ok := l.allow("client", now.Add(100*time.Millisecond))
+	if ok {
+		t.Fatal("a request over the limit was allowed")
+	}
+	if want := 150 * time.Millisecond; wait < want-time.Millisecond || wait > want+time.Millisecond {
+		t.Errorf("got wait %s, want %s", wait, want)
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := newRateLimiter(1, 1)
+	l.allow("idle", now)
+	l.allow("active", now.Add(rateLimiterIdle))
+	l.allow("active", now.Add(2*rateLimiterIdle))
+
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("the bucket of an idle client wasn't dropped")
+	}
+	if _, ok := l.buckets["active"]; !ok {
+		t.Error("the bucket of an active client was dropped")
+	}
+}
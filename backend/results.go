@@ -0,0 +1,192 @@
+package backend
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/czechbol/librespeedtest/defs"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultResultsLimit is the number of results listed when the request doesn't ask for a number
+	DefaultResultsLimit = 50
+	// MaxResultsLimit is the largest number of results listed at once
+	MaxResultsLimit = 1000
+)
+
+// resultCard is the share page of a single result
+var resultCard = template.Must(template.New("result").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Speed test result #{{.ID}}</title>
+<style>
+body { font-family: sans-serif; background: #f0f0f0; display: flex; justify-content: center; padding: 2em; }
+.card { background: #fff; border-radius: 8px; box-shadow: 0 2px 8px rgba(0,0,0,.2); padding: 1.5em 2em; min-width: 20em; }
+h1 { font-size: 1.2em; margin: 0 0 1em; }
+.grid { display: grid; grid-template-columns: 1fr 1fr; gap: 1em; }
+.label { color: #666; font-size: .9em; }
+.value { font-size: 1.8em; }
+.unit { font-size: .5em; color: #666; }
+.meta { color: #666; font-size: .85em; margin-top: 1.5em; }
+</style>
+</head>
+<body>
+<div class="card">
+<h1>LibreSpeed result #{{.ID}}</h1>
+<div class="grid">
+<div><div class="label">Download</div><div class="value">{{.Download}} <span class="unit">Mbps</span></div></div>
+<div><div class="label">Upload</div><div class="value">{{.Upload}} <span class="unit">Mbps</span></div></div>
+<div><div class="label">Ping</div><div class="value">{{.Ping}} <span class="unit">ms</span></div></div>
+<div><div class="label">Jitter</div><div class="value">{{.Jitter}} <span class="unit">ms</span></div></div>
+</div>
+<div class="meta">
+{{if .ISP}}<div>{{.ISP}}</div>{{end}}
+{{if .Server}}<div>Server: {{.Server}}</div>{{end}}
+<div>{{.Timestamp.Format "2006-01-02 15:04:05 MST"}}</div>
+</div>
+</div>
+</body>
+</html>
+`))
+
+// resultList is the reply of the JSON listing API
+type resultList struct {
+	Total   int      `json:"total"`
+	Offset  int      `json:"offset"`
+	Results []Result `json:"results"`
+}
+
+// sharePage renders the result card of the result given by ?id=, the page the share link points to
+func (s *Server) sharePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/results/" {
+		http.NotFound(w, r)
+		return
+	}
+	result, ok := s.lookupResult(w, r)
+	if !ok {
+		return
+	}
+
+	card := struct {
+		Result
+		ISP    string
+		Server string
+	}{Result: result}
+	var ispInfo defs.GetIPResult
+	if err := json.Unmarshal([]byte(result.ISPInfo), &ispInfo); err == nil {
+		card.ISP = publicISP(ispInfo.RawISPInfo)
+	}
+	var extra defs.TelemetryExtra
+	if err := json.Unmarshal([]byte(result.Extra), &extra); err == nil {
+		card.Server = extra.ServerName
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := resultCard.Execute(w, card); err != nil {
+		log.Debugf("Failed when rendering result %s: %s", result.ID, err)
+	}
+}
+
+// resultsJSON returns the result given by ?id=, or lists the results newest first,
+// paged with ?offset= and ?limit=. The results hold the clients' addresses, so the
+// ResultsToken has to be given
+func (s *Server) resultsJSON(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="results"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("id") != "" {
+		if result, ok := s.lookupResult(w, r); ok {
+			writeJSON(w, result)
+		}
+		return
+	}
+
+	offset, err := queryInt(query.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		http.Error(w, "invalid offset", http.StatusBadRequest)
+		return
+	}
+	limit, err := queryInt(query.Get("limit"), DefaultResultsLimit)
+	if err != nil || limit < 1 {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return
+	}
+	if limit > MaxResultsLimit {
+		limit = MaxResultsLimit
+	}
+
+	results, total, err := s.config.Results.List(offset, limit)
+	if err != nil {
+		log.Errorf("Failed to list the results: %s", err)
+		http.Error(w, "failed to list the results", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, resultList{Total: total, Offset: offset, Results: results})
+}
+
+// authorized checks the ResultsToken given as a bearer token or with ?token=
+func (s *Server) authorized(r *http.Request) bool {
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return s.config.ResultsToken != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(s.config.ResultsToken)) == 1
+}
+
+// lookupResult returns the result given by ?id=, replying with an error when there is none
+func (s *Server) lookupResult(w http.ResponseWriter, r *http.Request) (Result, bool) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing result id", http.StatusBadRequest)
+		return Result{}, false
+	}
+	result, ok, err := s.config.Results.Get(id)
+	if err != nil {
+		log.Errorf("Failed to get result %s: %s", id, err)
+		http.Error(w, "failed to get the result", http.StatusInternalServerError)
+		return Result{}, false
+	}
+	if !ok {
+		http.Error(w, "result not found", http.StatusNotFound)
+		return Result{}, false
+	}
+	return result, true
+}
+
+// publicISP describes the client's ISP for the share page, without the client's address
+func publicISP(info defs.IPInfoResponse) string {
+	var parts []string
+	for _, part := range []string{info.Organization, info.Country} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// queryInt parses a query parameter, returning def when it is empty
+func queryInt(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Debugf("Failed when writing JSON reply: %s", err)
+	}
+}
@@ -0,0 +1,189 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const testToken = "secret"
+
+// postResult posts a result to the telemetry endpoint and returns its ID
+func postResult(t *testing.T, s *Server, form url.Values) string {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/results/telemetry.php", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = "203.0.113.7:1234"
+	w := serve(s, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("telemetry got status %d: %s", w.Code, w.Body)
+	}
+	id := strings.TrimPrefix(w.Body.String(), "id ")
+	if !resultIDPattern.MatchString(id) {
+		t.Fatalf("telemetry replied %q", w.Body)
+	}
+	return id
+}
+
+func TestTelemetry(t *testing.T) {
+	store := &MemoryStore{}
+	s := newTestBackend(t, Config{Results: store})
+
+	id := postResult(t, s, url.Values{"dl": {"93.5"}, "ul": {"12.1"}, "ping": {"8"}, "jitter": {"1.2"}})
+	result, ok, _ := store.Get(id)
+	if !ok {
+		t.Fatal("the posted result wasn't stored")
+	}
+	if result.Download != "93.5" || result.Upload != "12.1" || result.IP != "203.0.113.7" {
+		t.Errorf("stored %+v", result)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("dl", "50")
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, "/results/telemetry", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := serve(s, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("a multipart form got status %d: %s", w.Code, w.Body)
+	}
+	result, ok, _ = store.Get(strings.TrimPrefix(w.Body.String(), "id "))
+	if !ok || result.Download != "50" {
+		t.Errorf("the multipart result stored is %+v", result)
+	}
+
+	w = serve(s, httptest.NewRequest(http.MethodGet, "/results/telemetry.php", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET got status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+
+	big := url.Values{"log": {strings.Repeat("x", DefaultMaxTelemetrySize)}}
+	r = httptest.NewRequest(http.MethodPost, "/results/telemetry", strings.NewReader(big.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if w := serve(s, r); w.Code != http.StatusBadRequest {
+		t.Errorf("an oversized form got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestResultsDisabled(t *testing.T) {
+	s := newTestBackend(t, Config{})
+	for _, target := range []string{"/results/telemetry.php", "/results/?id=1", "/results/json?token=x"} {
+		w := serve(s, httptest.NewRequest(http.MethodPost, target, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s got status %d without a store, want %d", target, w.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestSharePage(t *testing.T) {
+	s := newTestBackend(t, Config{Results: &MemoryStore{}})
+	id := postResult(t, s, url.Values{
+		"dl":      {"93.5"},
+		"ispinfo": {`{"processedString":"203.0.113.7 - Example ISP","rawIspInfo":{"ip":"203.0.113.7","org":"Example ISP","country":"CZ"}}`},
+		"extra":   {`{"server":"Prague"}`},
+	})
+
+	tests := []struct {
+		target   string
+		status   int
+		contains []string
+		excludes []string
+	}{
+		{"/results/?id=" + id, http.StatusOK, []string{"93.5", "Example ISP, CZ", "Server: Prague"}, []string{"203.0.113.7"}},
+		{"/results/?id=0000000000000000", http.StatusNotFound, nil, nil},
+		{"/results/", http.StatusBadRequest, nil, nil},
+		{"/results/other", http.StatusNotFound, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			w := serve(s, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if w.Code != tt.status {
+				t.Fatalf("got status %d, want %d", w.Code, tt.status)
+			}
+			for _, s := range tt.contains {
+				if !strings.Contains(w.Body.String(), s) {
+					t.Errorf("the page doesn't contain %q", s)
+				}
+			}
+			for _, s := range tt.excludes {
+				if strings.Contains(w.Body.String(), s) {
+					t.Errorf("the page contains %q", s)
+				}
+			}
+		})
+	}
+}
+
+func TestResultsJSON(t *testing.T) {
+	s := newTestBackend(t, Config{Results: &MemoryStore{}, ResultsToken: testToken})
+	var ids []string
+	for _, dl := range []string{"1", "2", "3"} {
+		ids = append(ids, postResult(t, s, url.Values{"dl": {dl}}))
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		auth   string
+		status int
+		total  int
+		dl     []string
+	}{
+		{"no token", "/results/json", "", http.StatusUnauthorized, 0, nil},
+		{"wrong token", "/results/json?token=wrong", "", http.StatusUnauthorized, 0, nil},
+		{"wrong bearer token", "/results/json?token=" + testToken, "Bearer wrong", http.StatusUnauthorized, 0, nil},
+		{"query token", "/results/json?token=" + testToken, "", http.StatusOK, 3, []string{"3", "2", "1"}},
+		{"bearer token", "/results/json?limit=1&offset=1", "Bearer " + testToken, http.StatusOK, 3, []string{"2"}},
+		{"invalid limit", "/results/json?limit=0", "Bearer " + testToken, http.StatusBadRequest, 0, nil},
+		{"invalid offset", "/results/json?offset=-1", "Bearer " + testToken, http.StatusBadRequest, 0, nil},
+		{"single result", "/results/json?id=" + ids[0], "Bearer " + testToken, http.StatusOK, 0, []string{"1"}},
+		{"unknown result", "/results/json?id=0000000000000000", "Bearer " + testToken, http.StatusNotFound, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.auth != "" {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			w := serve(s, r)
+			if w.Code != tt.status {
+				t.Fatalf("got status %d, want %d", w.Code, tt.status)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var list resultList
+			if strings.Contains(tt.target, "id=") {
+				var result Result
+				if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+					t.Fatal(err)
+				}
+				list.Results = []Result{result}
+			} else if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+				t.Fatal(err)
+			}
+			if list.Total != tt.total || len(list.Results) != len(tt.dl) {
+				t.Fatalf("listed %d of %d results, want %d of %d", len(list.Results), list.Total, len(tt.dl), tt.total)
+			}
+			for i, result := range list.Results {
+				if result.Download != tt.dl[i] {
+					t.Errorf("result %d has download %s, want %s", i, result.Download, tt.dl[i])
+				}
+			}
+		})
+	}
+
+	// without a token the listing isn't served at all
+	s = newTestBackend(t, Config{Results: &MemoryStore{}})
+	w := serve(s, httptest.NewRequest(http.MethodGet, "/results/json", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("the listing without a token got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
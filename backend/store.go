@@ -0,0 +1,168 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FileStore keeps the results in a file with one JSON object per line, new results are appended
+// and the whole file is loaded when it is opened. Once the file holds twice as many results as
+// are kept, it is rewritten without the dropped ones
+type FileStore struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	max     int
+	lines   int
+	results []Result
+}
+
+// OpenFileStore opens the results file at path, creating it when it doesn't exist. It keeps up to
+// max results, the oldest ones are dropped first, DefaultMaxResults is used when max is not positive
+func OpenFileStore(path string, max int) (*FileStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	// a write cut short leaves a broken last line, the next result goes on a line of its own
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		if _, err := f.Write([]byte{'\n'}); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	if max <= 0 {
+		max = DefaultMaxResults
+	}
+	s := &FileStore{path: path, file: f, max: max}
+	for i, line := range bytes.Split(b, []byte{'\n'}) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		s.lines++
+		var result Result
+		if err := json.Unmarshal(line, &result); err != nil {
+			log.Warnf("Skipping line %d of %s: %s", i+1, path, err)
+			continue
+		}
+		s.results = keepNewest(append(s.results, result), s.max)
+	}
+	s.compactIfNeeded()
+	return s, nil
+}
+
+// Save implements ResultStore
+func (s *FileStore) Save(result Result) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, err := newResultID(s.results)
+	if err != nil {
+		return "", err
+	}
+	result.ID = id
+	b, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.file.Write(append(b, '\n')); err != nil {
+		return "", err
+	}
+	if err := s.file.Sync(); err != nil {
+		return "", err
+	}
+	s.lines++
+	s.results = keepNewest(append(s.results, result), s.max)
+	s.compactIfNeeded()
+	return result.ID, nil
+}
+
+// Get implements ResultStore
+func (s *FileStore) Get(id string) (Result, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, ok := findResult(s.results, id)
+	return result, ok, nil
+}
+
+// List implements ResultStore
+func (s *FileStore) List(offset int, limit int) ([]Result, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return listResults(s.results, offset, limit), len(s.results), nil
+}
+
+// compactIfNeeded rewrites the file with the kept results once it holds twice as many lines,
+// a failure is only logged as the results are stored either way
+func (s *FileStore) compactIfNeeded() {
+	if s.lines < 2*s.max {
+		return
+	}
+	if err := s.compact(); err != nil {
+		log.Warnf("Failed to compact %s: %s", s.path, err)
+	}
+}
+
+// compact replaces the file with one holding only the kept results
+func (s *FileStore) compact() error {
+	var buf bytes.Buffer
+	for _, result := range s.results {
+		b, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(b, '\n'))
+	}
+
+	// write to a temporary file first, so a crash never leaves half of the results behind
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// the temporary file is the results file now, new results are appended to it
+	s.file.Close()
+	s.file = tmp
+	s.lines = len(s.results)
+	return nil
+}
+
+// Close closes the results file
+func (s *FileStore) Close() error {
+	return s.file.Close()
+}
+
+// listResults returns up to limit results newest first, skipping the offset newest ones
+func listResults(results []Result, offset int, limit int) []Result {
+	list := []Result{}
+	for i := len(results) - 1 - offset; i >= 0 && len(list) < limit; i-- {
+		list = append(list, results[i])
+	}
+	return list
+}
@@ -0,0 +1,199 @@
+package backend
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+var resultIDPattern = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// saveResults saves the results numbered from first to first+n-1, with the number as their ping,
+// and returns their IDs
+func saveResults(t *testing.T, store ResultStore, first, n int) []string {
+	t.Helper()
+	var ids []string
+	for i := first; i < first+n; i++ {
+		id, err := store.Save(Result{Ping: strconv.Itoa(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// checkStore checks the store holds the results numbered from first to last, listed newest first
+func checkStore(t *testing.T, store ResultStore, ids []string, first, last int) {
+	t.Helper()
+	results, total, err := store.List(0, len(ids))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := last - first + 1; total != want || len(results) != want {
+		t.Fatalf("listed %d of %d results, want %d", len(results), total, want)
+	}
+	for i, result := range results {
+		if want := strconv.Itoa(last - i); result.Ping != want {
+			t.Errorf("result %d is number %s, want %s", i, result.Ping, want)
+		}
+	}
+
+	for i, id := range ids {
+		result, ok, err := store.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kept := i >= first && i <= last; ok != kept {
+			t.Errorf("result %d found %v, want %v", i, ok, kept)
+		} else if ok && (result.ID != id || result.Ping != strconv.Itoa(i)) {
+			t.Errorf("result %s is %+v", id, result)
+		}
+	}
+}
+
+func TestResultIDs(t *testing.T) {
+	ids := saveResults(t, &MemoryStore{}, 0, 100)
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if !resultIDPattern.MatchString(id) {
+			t.Errorf("ID %q is not 16 hex digits", id)
+		}
+		if seen[id] {
+			t.Errorf("ID %s was given twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	tests := []struct {
+		name  string
+		max   int
+		saved int
+		first int
+	}{
+		{"below the limit", 5, 3, 0},
+		{"at the limit", 5, 5, 0},
+		{"oldest dropped", 5, 8, 3},
+		{"default limit", 0, 8, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &MemoryStore{Max: tt.max}
+			ids := saveResults(t, store, 0, tt.saved)
+			checkStore(t, store, ids, tt.first, tt.saved-1)
+		})
+	}
+}
+
+func TestListResults(t *testing.T) {
+	store := &MemoryStore{}
+	saveResults(t, store, 0, 5)
+
+	tests := []struct {
+		offset, limit int
+		want          []string
+	}{
+		{0, 2, []string{"4", "3"}},
+		{3, 10, []string{"1", "0"}},
+		{5, 10, []string{}},
+	}
+	for _, tt := range tests {
+		results, total, err := store.List(tt.offset, tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pings []string
+		for _, result := range results {
+			pings = append(pings, result.Ping)
+		}
+		if total != 5 || len(pings) != len(tt.want) {
+			t.Errorf("offset %d, limit %d: listed %v of %d, want %v of 5", tt.offset, tt.limit, pings, total, tt.want)
+			continue
+		}
+		for i := range pings {
+			if pings[i] != tt.want[i] {
+				t.Errorf("offset %d, limit %d: listed %v, want %v", tt.offset, tt.limit, pings, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.jsonl")
+
+	store, err := OpenFileStore(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := saveResults(t, store, 0, 5)
+	checkStore(t, store, ids, 2, 4)
+	if got := countLines(t, path); got != 5 {
+		t.Errorf("the file has %d lines before the compaction, want 5", got)
+	}
+
+	// the sixth line makes it twice the kept results
+	ids = append(ids, saveResults(t, store, 5, 1)...)
+	if got := countLines(t, path); got != 3 {
+		t.Errorf("the file has %d lines after the compaction, want 3", got)
+	}
+	// results keep going to the compacted file
+	ids = append(ids, saveResults(t, store, 6, 1)...)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenFileStore(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	checkStore(t, reopened, ids, 4, 6)
+}
+
+func TestFileStoreBrokenLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.jsonl")
+	// a result, a line that isn't JSON and a write cut short
+	data := `{"id":"00000000000000aa","ping":"0"}` + "\nnot json\n" + `{"id":"00000000000000bb","pi`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenFileStore(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := store.Save(Result{Ping: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	reopened, err := OpenFileStore(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	checkStore(t, reopened, []string{"00000000000000aa", id}, 0, 1)
+}
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var lines int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines++
+	}
+	return lines
+}
@@ -0,0 +1,159 @@
+package backend
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultMaxResults is the default number of results a store keeps, the oldest ones are dropped first
+const DefaultMaxResults = 10000
+
+// Result is a test result posted to the telemetry endpoint, with the fields of the
+// LibreSpeed results database
+type Result struct {
+	// ID is random, so the share links can't be guessed from one another
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	IP        string    `json:"ip"`
+	ISPInfo   string    `json:"ispinfo"`
+	Extra     string    `json:"extra"`
+	UserAgent string    `json:"ua"`
+	Language  string    `json:"lang"`
+	Download  string    `json:"dl"`
+	Upload    string    `json:"ul"`
+	Ping      string    `json:"ping"`
+	Jitter    string    `json:"jitter"`
+	Log       string    `json:"log"`
+}
+
+// ResultStore keeps the results posted to the telemetry endpoint
+type ResultStore interface {
+	// Save stores the result and returns the ID it was given
+	Save(result Result) (string, error)
+	// Get returns the result with the given ID, false when there is none
+	Get(id string) (Result, bool, error)
+	// List returns up to limit results newest first, skipping the offset newest ones,
+	// along with the number of stored results
+	List(offset int, limit int) ([]Result, int, error)
+}
+
+// MemoryStore keeps the results in memory, they are lost when the process exits
+type MemoryStore struct {
+	// Max limits the stored results, the oldest ones are dropped first. DefaultMaxResults is used when zero
+	Max int
+
+	mu      sync.Mutex
+	results []Result
+}
+
+// Save implements ResultStore
+func (m *MemoryStore) Save(result Result) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, err := newResultID(m.results)
+	if err != nil {
+		return "", err
+	}
+	result.ID = id
+	m.results = keepNewest(append(m.results, result), m.Max)
+	return result.ID, nil
+}
+
+// Get implements ResultStore
+func (m *MemoryStore) Get(id string) (Result, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result, ok := findResult(m.results, id)
+	return result, ok, nil
+}
+
+// List implements ResultStore
+func (m *MemoryStore) List(offset int, limit int) ([]Result, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return listResults(m.results, offset, limit), len(m.results), nil
+}
+
+// newResultID returns a random result ID that none of the results has
+func newResultID(results []Result) (string, error) {
+	b := make([]byte, 8)
+	for {
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		id := hex.EncodeToString(b)
+		if _, taken := findResult(results, id); !taken {
+			return id, nil
+		}
+	}
+}
+
+// findResult returns the result with the given ID, false when there is none
+func findResult(results []Result, id string) (Result, bool) {
+	for i := len(results) - 1; i >= 0; i-- {
+		if results[i].ID == id {
+			return results[i], true
+		}
+	}
+	return Result{}, false
+}
+
+// keepNewest drops the oldest results beyond max, DefaultMaxResults is used when max is not positive
+func keepNewest(results []Result, max int) []Result {
+	if max <= 0 {
+		max = DefaultMaxResults
+	}
+	if len(results) <= max {
+		return results
+	}
+	return results[len(results)-max:]
+}
+
+// telemetry stores a posted result and replies with its ID as "id N", which the client builds
+// the share link from
+func (s *Server) telemetry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, DefaultMaxTelemetrySize)
+	// ParseMultipartForm hides the errors of a url-encoded form behind ErrNotMultipart,
+	// so those are parsed on their own first
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid telemetry data", http.StatusBadRequest)
+		return
+	}
+	if err := r.ParseMultipartForm(DefaultMaxTelemetrySize); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		http.Error(w, "invalid telemetry data", http.StatusBadRequest)
+		return
+	}
+
+	result := Result{
+		Timestamp: time.Now(),
+		IP:        s.clientIP(r),
+		ISPInfo:   r.FormValue("ispinfo"),
+		Extra:     r.FormValue("extra"),
+		UserAgent: r.UserAgent(),
+		Language:  r.Header.Get("Accept-Language"),
+		Download:  r.FormValue("dl"),
+		Upload:    r.FormValue("ul"),
+		Ping:      r.FormValue("ping"),
+		Jitter:    r.FormValue("jitter"),
+		Log:       r.FormValue("log"),
+	}
+	id, err := s.config.Results.Save(result)
+	if err != nil {
+		log.Errorf("Failed to store a result: %s", err)
+		http.Error(w, "failed to store the result", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "id %s", id)
+}
@@ -1,8 +1,15 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"math"
+	"io"
+	"os"
+	"regexp"
+	"sync"
+	"text/tabwriter"
 	"time"
 
 	"github.com/briandowns/spinner"
@@ -12,11 +19,7 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-const (
-	pingCount = 10
-)
-
-func verboseSpeedTest(cliOpts *CLIOptions) error {
+func verboseSpeedTest(ctx context.Context, cliOpts *CLIOptions) error {
 	// Server ranking
 	var pb *spinner.Spinner
 	var err error
@@ -25,99 +28,512 @@ func verboseSpeedTest(cliOpts *CLIOptions) error {
 		pb.Suffix = " Selecting the fastest server based on ping..."
 		pb.Start()
 	}
-	cliOpts.TestServer, err = speedtest.RankServers(&(*cliOpts).ServerList)
+	cliOpts.TestServers, err = cliOpts.topServers(ctx)
 	if err != nil {
+		if pb != nil {
+			pb.FinalMSG = ""
+			pb.Stop()
+		}
 		return err
 	}
+	cliOpts.TestServer = cliOpts.TestServers[0]
 	if pb != nil {
-		pb.FinalMSG = fmt.Sprintf(
-			"Selected server: %s [%s]\n",
-			cliOpts.TestServer.Name,
-			cliOpts.TestServer.Server,
-		)
+		pb.FinalMSG = ""
+		for _, server := range cliOpts.TestServers {
+			pb.FinalMSG += fmt.Sprintf("Selected server: %s [%s]\n", server.Name, server.Server)
+		}
 		pb.Stop()
 	}
 
-	ispInfo, err := cliOpts.TestServer.WorkaroundGetIPInfo(cliOpts.DistanceUnit)
+	multi := len(cliOpts.TestServers) > 1
+	opts := cliOpts.speedtestOptions()
+	if multi && cliOpts.Parallel {
+		// the progress of servers tested at the same time can't be told apart
+		pb = spinner.New(spinner.CharSets[11], 100*time.Millisecond)
+		pb.Suffix = fmt.Sprintf(" Testing %d servers in parallel...", len(cliOpts.TestServers))
+		pb.Start()
+	} else {
+		opts.Events = &spinnerProgress{
+			useBytes:     cliOpts.Bytes,
+			binaryBase:   cliOpts.BinaryBase,
+			showIPFamily: cliOpts.DualStack,
+			showServer:   multi,
+		}
+	}
+	reports, summary, err := speedtest.MultiSpeedTest(ctx, cliOpts.TestServers, opts, cliOpts.Parallel)
+	if multi && cliOpts.Parallel {
+		pb.Stop()
+	}
 	if err != nil {
-		log.Errorf("Failed to get IP info: %s", err)
 		return err
 	}
 
-	// Ping and Jitter test
-	pb = spinner.New(spinner.CharSets[11], 100*time.Millisecond)
-	pb.Suffix = " Pinging server..."
-	pb.Start()
+	for _, report := range reports {
+		if multi && cliOpts.Parallel {
+			fmt.Printf(
+				"%s:\tDownload %s\tUpload %s\tPing %.2f ms\n",
+				report.Server.Name,
+				defs.HumanizeSpeed(report.Download*1000*1000/8, cliOpts.Bytes, cliOpts.BinaryBase),
+				defs.HumanizeSpeed(report.Upload*1000*1000/8, cliOpts.Bytes, cliOpts.BinaryBase),
+				report.Ping,
+			)
+		}
+		for _, rep := range report.StackReports() {
+			if rep.Bufferbloat != "" && multi {
+				fmt.Printf("Bufferbloat grade (%s): %s\n", report.Server.Name, rep.Bufferbloat)
+			} else if rep.Bufferbloat != "" {
+				fmt.Printf("Bufferbloat grade: %s\n", rep.Bufferbloat)
+			}
+		}
 
-	ping, jitter, err := cliOpts.TestServer.ICMPPingAndJitter(pingCount)
+		// print share link if --share is given
+		if report.ShareLink != "" {
+			log.Warnf("Share your result: %s", report.ShareLink)
+		}
+	}
+	if multi {
+		printSummary(summary)
+	}
+	return nil
+}
+
+// rankServers ranks the server list. The client's location is looked up when locate is set or
+// when the ranking depends on the distance
+func (cliOpts *CLIOptions) rankServers(ctx context.Context, locate bool) ([]speedtest.RankedServer, error) {
+	opts := speedtest.RankOptions{
+		Probes:         cliOpts.RankProbes,
+		DistanceWeight: cliOpts.DistanceWeight,
+		Nearest:        cliOpts.Nearest,
+		Radius:         defs.DistanceToKm(cliOpts.Radius, cliOpts.DistanceUnit),
+		Workers:        cliOpts.RankWorkers,
+		ServerTimeout:  cliOpts.ServerTimeout,
+		Timeout:        cliOpts.RankTimeout,
+		StopAfter:      cliOpts.RankStopAfter,
+	}
+	if cliOpts.Privacy && cliOpts.geo == nil {
+		if opts.DistanceWeight != 0 || opts.Nearest > 0 || opts.Radius > 0 {
+			log.Warn("Ranking without the distance, --privacy needs --geo mmdb to locate the servers")
+		}
+	} else if locate || opts.DistanceWeight != 0 || opts.Nearest > 0 || opts.Radius > 0 {
+		location, err := cliOpts.clientLocation(ctx)
+		if err != nil {
+			log.Warnf("Unable to locate you, ranking without the distance: %s", err)
+		}
+		opts.ClientLocation = location
+	}
+	return speedtest.Rank(ctx, cliOpts.ServerList, opts)
+}
+
+// loadTelemetryServer fills in the telemetry server settings the flags left empty from --telemetry-json
+// and checks the telemetry level
+func (cliOpts *CLIOptions) loadTelemetryServer() error {
+	if cliOpts.TelemetryJSON != "" {
+		b, err := os.ReadFile(cliOpts.TelemetryJSON)
+		if err != nil {
+			return err
+		}
+		var t defs.TelemetryServer
+		if err := json.Unmarshal(b, &t); err != nil {
+			return fmt.Errorf("invalid telemetry settings in %s: %w", cliOpts.TelemetryJSON, err)
+		}
+		flags := &cliOpts.TelemetryServer
+		for _, field := range []struct{ flag, file *string }{
+			{&flags.Level, &t.Level},
+			{&flags.Server, &t.Server},
+			{&flags.Path, &t.Path},
+			{&flags.Share, &t.Share},
+		} {
+			if *field.flag == "" {
+				*field.flag = *field.file
+			}
+		}
+	}
+
+	switch cliOpts.TelemetryServer.Level {
+	case "", defs.TelemetryLevelDisabled, defs.TelemetryLevelBasic, defs.TelemetryLevelFull, defs.TelemetryLevelDebug:
+		return nil
+	}
+	return fmt.Errorf(
+		"unknown telemetry level %q, use 'disabled', 'basic', 'full' or 'debug'",
+		cliOpts.TelemetryServer.Level,
+	)
+}
+
+// geoProvider returns the geolocation provider selected by --geo, nil leaves ipinfo.io to the servers
+func (cliOpts *CLIOptions) geoProvider() (defs.GeoProvider, error) {
+	switch cliOpts.Geo {
+	case "ipinfo":
+		return &defs.IPInfoProvider{Token: cliOpts.IPInfoToken, Client: cliOpts.client}, nil
+	case "backend":
+		if len(cliOpts.ServerList) == 0 {
+			return nil, errors.New("no server to look you up with")
+		}
+		return &defs.BackendProvider{
+			Server:   &cliOpts.ServerList[0],
+			Fallback: &defs.IPInfoProvider{Token: cliOpts.IPInfoToken, Client: cliOpts.client},
+		}, nil
+	case "mmdb":
+		return defs.OpenMMDB(cliOpts.GeoDB...)
+	}
+	if cliOpts.IPInfoToken != "" {
+		return &defs.IPInfoProvider{Token: cliOpts.IPInfoToken, Client: cliOpts.client}, nil
+	}
+	return nil, nil
+}
+
+// clientLocation looks up the client's location as "latitude,longitude". The providers that can't
+// look up the client's own address get it from the getIP endpoint of the first server
+func (cliOpts *CLIOptions) clientLocation(ctx context.Context) (string, error) {
+	provider := cliOpts.geo
+	if provider == nil {
+		provider = &defs.IPInfoProvider{Client: cliOpts.client}
+	}
+	info, err := provider.Lookup(ctx, "")
+	if errors.Is(err, defs.ErrAddressRequired) && len(cliOpts.ServerList) > 0 {
+		var ipInfo *defs.GetIPResult
+		if cliOpts.Privacy {
+			ipInfo, err = cliOpts.ServerList[0].GetIP(ctx)
+		} else {
+			ipInfo, err = cliOpts.ServerList[0].GetIPInfo(ctx, cliOpts.DistanceUnit)
+		}
+		if err == nil {
+			info, err = provider.Lookup(ctx, ipInfo.RawISPInfo.IP)
+		}
+	}
 	if err != nil {
-		return err
+		return "", err
 	}
+	return info.Location, nil
+}
 
-	if pb != nil {
-		pb.FinalMSG = fmt.Sprintf(
-			"Ping: %.2f ms\tJitter: %.2f ms\n",
-			ping,
-			jitter,
+// topServers returns the servers selected by --top from the ranked server list
+func (cliOpts *CLIOptions) topServers(ctx context.Context) ([]defs.Server, error) {
+	ranked, err := cliOpts.rankServers(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	return speedtest.TopServers(ranked, cliOpts.Top)
+}
+
+// printRankedServers prints the ranked servers as a table, best first, with the distances in unit
+func printRankedServers(out io.Writer, ranked []speedtest.RankedServer, unit string) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Rank\tID\tName\tLatency\tJitter\tLoss\tDistance\tScore\tSponsor")
+	for i, r := range ranked {
+		distance := "-"
+		if r.Located {
+			distance = fmt.Sprintf("%.0f %s", defs.ConvertDistance(r.Distance, unit), unit)
+		}
+		if !r.Reachable {
+			status := "unreachable"
+			if r.Skipped {
+				status = "skipped"
+			}
+			fmt.Fprintf(w, "-\t%d\t%s\t%s\t\t\t%s\t\t%s\n", r.Server.ID, r.Server.Name, status, distance, r.Server.Sponsor())
+			continue
+		}
+		fmt.Fprintf(
+			w,
+			"%d\t%d\t%s\t%.2f ms\t%.2f ms\t%.0f%%\t%s\t%.2f\t%s\n",
+			i+1,
+			r.Server.ID,
+			r.Server.Name,
+			r.Latency,
+			r.Jitter,
+			r.Loss*100,
+			distance,
+			r.Score,
+			r.Server.Sponsor(),
 		)
-		pb.Stop()
 	}
+	return w.Flush()
+}
 
-	// Download test
-	var downloadValue float64
-	var bytesRead int
-	if cliOpts.NoDownload {
-		log.Info("Download test is disabled")
-	} else {
-		downloadValue, bytesRead, err = cliOpts.TestServer.ManualDownload(true, cliOpts.Bytes, cliOpts.BinaryBase, cliOpts.Concurrent, cliOpts.Chunks, time.Duration(cliOpts.Duration)*time.Second)
+// printSummary prints the summary of a multi-server test
+func printSummary(summary *defs.Summary) {
+	fmt.Printf("Summary of %d servers", summary.Servers)
+	if summary.Failed > 0 {
+		fmt.Printf(" (%d failed)", summary.Failed)
+	}
+	fmt.Println(":")
+	fmt.Printf(
+		"Ping:   %.2f ms mean (%.2f - %.2f ms)\n",
+		summary.Ping.Mean, summary.Ping.Min, summary.Ping.Max,
+	)
+	fmt.Printf(
+		"Download rate:  %.2f Mbps mean (%.2f - %.2f Mbps)\n",
+		summary.Download.Mean, summary.Download.Min, summary.Download.Max,
+	)
+	fmt.Printf(
+		"Upload rate:    %.2f Mbps mean (%.2f - %.2f Mbps)\n",
+		summary.Upload.Mean, summary.Upload.Min, summary.Upload.Max,
+	)
+	if summary.Parallel {
+		fmt.Printf(
+			"Combined rate:  %.2f Mbps down, %.2f Mbps up\n",
+			summary.Download.Total, summary.Upload.Total,
+		)
+	}
+}
+
+// speedtestOptions translates the CLI options to speedtest.Options
+func (cliOpts *CLIOptions) speedtestOptions() speedtest.Options {
+	opts := speedtest.Options{
+		NoDownload:     cliOpts.NoDownload,
+		NoUpload:       cliOpts.NoUpload,
+		PingCount:      speedtest.DefaultPingCount,
+		DistanceUnit:   cliOpts.DistanceUnit,
+		Requests:       cliOpts.Concurrent,
+		Chunks:         cliOpts.Chunks,
+		NoPrealloc:     cliOpts.NoPreAllocate,
+		UploadSize:     cliOpts.UploadSize,
+		Duration:       time.Duration(cliOpts.Duration) * time.Second,
+		NoShare:        !cliOpts.Share,
+		IPInfoFallback: cliOpts.IPInfoFallback,
+		Geo:            cliOpts.geo,
+		Privacy:        cliOpts.Privacy,
+		Telemetry:      cliOpts.TelemetryServer,
+		TelemetryExtra: cliOpts.TelemetryExtra,
+		Client:         cliOpts.client,
+		ClientOptions:  cliOpts.clientOptions(),
+		DualStack:      cliOpts.DualStack,
+		Responsiveness: cliOpts.Responsiveness,
+		Bidirectional:  cliOpts.Bidirectional,
+		AutoTune:       cliOpts.AutoTune,
+		SampleInterval: time.Duration(cliOpts.SampleInterval) * time.Millisecond,
+		Warmup:         cliOpts.Warmup,
+		Aggregation:    defs.Aggregation(cliOpts.Aggregation),
+	}
+	if cliOpts.EarlyStop {
+		opts.EarlyStop = &defs.EarlyStop{
+			Tolerance:   cliOpts.StableTolerance / 100,
+			Window:      cliOpts.StableWindow,
+			MinDuration: cliOpts.MinDuration,
+		}
+	}
+	if cliOpts.LoadedLatency {
+		opts.LatencyInterval = time.Duration(cliOpts.LatencyInterval) * time.Millisecond
+	}
+	return opts
+}
+
+// clientOptions translates the CLI options to speedtest.ClientOptions
+func (cliOpts *CLIOptions) clientOptions() speedtest.ClientOptions {
+	opts := speedtest.ClientOptions{
+		Timeout:        time.Duration(cliOpts.Timeout) * time.Second,
+		SkipCertVerify: cliOpts.SkipCertVerify,
+		SourceIP:       cliOpts.SourceIP,
+		Interface:      cliOpts.Interface,
+		Proxy:          cliOpts.Proxy,
+	}
+	if cliOpts.IPv4 {
+		opts.IPVersion = 4
+	} else if cliOpts.IPv6 {
+		opts.IPVersion = 6
+	}
+	return opts
+}
+
+// loadServerList fills the server list from --server-json and --local-json, or from LibreSpeed.org
+// when neither is given or --merge-servers is set. Remote lists are cached
+func (cliOpts *CLIOptions) loadServerList(ctx context.Context) error {
+	cache := speedtest.ServerListCache{TTL: cliOpts.ServersTTL, Refresh: cliOpts.RefreshServers}
+
+	var lists [][]defs.Server
+	for _, source := range []string{cliOpts.ServerJSON, cliOpts.LocalJSON} {
+		if source == "" {
+			continue
+		}
+		log.Infof("Loading server list from %s", source)
+		servers, err := cache.Load(ctx, cliOpts.client, source)
 		if err != nil {
-			log.Errorf("Failed to get download speed: %s", err)
+			log.WithField("source", source).Error("Unable to load server list")
 			return err
 		}
+		lists = append(lists, *servers)
 	}
 
-	// Upload test
-	var uploadValue float64
-	var bytesWritten int
-	if cliOpts.NoUpload {
-		log.Info("Upload test is disabled")
-	} else {
-		uploadValue, bytesWritten, err = cliOpts.TestServer.ManualUpload(cliOpts.NoPreAllocate, true, cliOpts.Bytes, cliOpts.BinaryBase, cliOpts.Concurrent, cliOpts.Chunks, time.Duration(cliOpts.Duration)*time.Second)
+	if len(lists) == 0 || cliOpts.MergeServers {
+		log.Info("Fetching server list")
+		// a broken entry of the public list only takes that server out
+		publicCache := cache
+		publicCache.SkipInvalid = true
+		servers, err := publicCache.Fetch(ctx, cliOpts.client, speedtest.ServerListUrl)
 		if err != nil {
-			log.Errorf("Failed to get upload speed: %s", err)
+			log.WithField("url", speedtest.ServerListUrl).
+				Error("Unable to fetch remote server list")
 			return err
 		}
+		lists = append(lists, *servers)
+	}
+
+	cliOpts.ServerList = speedtest.MergeServerLists(append([][]defs.Server{cliOpts.ServerList}, lists...)...)
+	return nil
+}
+
+// serverFilter translates the CLI options to speedtest.ServerFilter
+func (cliOpts *CLIOptions) serverFilter() (speedtest.ServerFilter, error) {
+	filter := speedtest.ServerFilter{
+		IDs:     cliOpts.ServerIDs,
+		Exclude: cliOpts.ExcludeIDs,
+	}
+
+	var err error
+	if cliOpts.ServerName != "" {
+		if filter.Name, err = regexp.Compile(cliOpts.ServerName); err != nil {
+			return filter, fmt.Errorf("invalid --server-name: %w", err)
+		}
+	}
+	if cliOpts.Sponsor != "" {
+		if filter.Sponsor, err = regexp.Compile(cliOpts.Sponsor); err != nil {
+			return filter, fmt.Errorf("invalid --sponsor: %w", err)
+		}
+	}
+	return filter, nil
+}
+
+// flatReports flattens the reports into CSV rows, one per server. A dual-stack report gets a row
+// per address family
+func flatReports(reports []defs.Report) []defs.FlatReport {
+	var flat []defs.FlatReport
+	for _, report := range reports {
+		for _, rep := range report.StackReports() {
+			flat = append(flat, rep.GetFlatReport())
+		}
 	}
+	return flat
+}
+
+// multiReport is the JSON output of a multi-server test
+type multiReport struct {
+	Reports []defs.Report `json:"reports"`
+	Summary *defs.Summary `json:"summary"`
+}
+
+// jsonOutput returns what the JSON formats print: the list of reports, or the reports together
+// with their summary for a multi-server test
+func jsonOutput(reports []defs.Report, summary *defs.Summary) interface{} {
+	if summary == nil {
+		return reports
+	}
+	return multiReport{Reports: reports, Summary: summary}
+}
+
+// spinnerProgress renders the speed test progress events as terminal spinners
+type spinnerProgress struct {
+	useBytes     bool
+	binaryBase   bool
+	showIPFamily bool
+	showServer   bool
 
-	report := defs.Report{
-		Timestamp:     time.Now(),
-		Ping:          math.Round(ping*100) / 100,
-		Jitter:        math.Round(jitter*100) / 100,
-		Download:      math.Round(downloadValue*100) / 100,
-		Upload:        math.Round(uploadValue*100) / 100,
-		BytesReceived: bytesRead,
-		BytesSent:     bytesWritten,
-		Server:        cliOpts.TestServer,
-		Client:        defs.Client{IPInfoResponse: ispInfo.RawISPInfo},
-	}
-
-	// print share link if --share is given
-	if cliOpts.Share {
-		var extra defs.TelemetryExtra
-		extra.ServerName = cliOpts.TestServer.Name
-		extra.Extra = ""
-		telemetryServer := defs.TelemetryServer{
-			Level:  speedtest.DefaultTelemetryLevel,
-			Server: speedtest.DefaultTelemetryServer,
-			Path:   speedtest.DefaultTelemetryPath,
-			Share:  speedtest.DefaultTelemetryShare,
-		}
-		if link, err := speedtest.SendTelemetry(telemetryServer, extra, ispInfo, &report, &cliOpts.TestServer.TLog); err != nil {
-			log.Errorf("Error when sending telemetry data: %s", err)
+	lock        sync.Mutex
+	pb          *spinner.Spinner
+	server      string
+	phase       defs.Phase
+	speed       float64
+	uploadSpeed float64
+}
+
+// HandleEvent implements defs.EventHandler
+func (p *spinnerProgress) HandleEvent(e defs.Event) {
+	switch e.Type {
+	case defs.EventPhaseStarted:
+		if p.showServer && e.Server != p.server {
+			fmt.Printf("Server: %s\n", e.Server)
+			p.server = e.Server
+		}
+		if p.showIPFamily && e.Phase == defs.PhasePing {
+			fmt.Printf("IPv%d:\n", e.IPVersion)
+		}
+		p.lock.Lock()
+		p.phase, p.speed, p.uploadSpeed = e.Phase, 0, 0
+		p.lock.Unlock()
+		p.pb = spinner.New(spinner.CharSets[11], 100*time.Millisecond)
+		switch e.Phase {
+		case defs.PhasePing:
+			p.pb.Suffix = " Pinging server..."
+		case defs.PhaseDownload:
+			p.pb.Prefix = "Downloading...  "
+			p.pb.PostUpdate = p.updateSpeed
+		case defs.PhaseUpload:
+			p.pb.Prefix = "Uploading...  "
+			p.pb.PostUpdate = p.updateSpeed
+		case defs.PhaseBidirectional:
+			p.pb.Prefix = "Downloading and uploading...  "
+			p.pb.PostUpdate = p.updateBidirectionalSpeed
+		case defs.PhaseTuning:
+			p.pb.Prefix = "Tuning...  "
+			p.pb.PostUpdate = p.updateSpeed
+		case defs.PhaseResponsiveness:
+			p.pb.Prefix = "Measuring responsiveness...  "
+			p.pb.PostUpdate = p.updateSpeed
+		}
+		p.pb.Start()
+	case defs.EventThroughputSample:
+		p.lock.Lock()
+		if p.phase == defs.PhaseBidirectional && e.Phase == defs.PhaseUpload {
+			p.uploadSpeed = e.Speed
 		} else {
-			report.ShareLink = link
-			log.Warnf("Share your result: %s", link)
+			p.speed = e.Speed
+		}
+		p.lock.Unlock()
+	case defs.EventPhaseFinished:
+		if p.pb == nil {
+			return
+		}
+		switch e.Phase {
+		case defs.PhasePing:
+			p.pb.FinalMSG = fmt.Sprintf("Ping: %.2f ms\tJitter: %.2f ms\n", e.Ping, e.Jitter)
+		case defs.PhaseDownload:
+			p.pb.FinalMSG = fmt.Sprintf("Download rate:\t%s\n", defs.HumanizeSpeed(e.Speed, p.useBytes, p.binaryBase))
+		case defs.PhaseUpload:
+			p.pb.FinalMSG = fmt.Sprintf("Upload rate:\t%s\n", defs.HumanizeSpeed(e.Speed, p.useBytes, p.binaryBase))
+		case defs.PhaseBidirectional:
+			p.pb.FinalMSG = fmt.Sprintf(
+				"Bidirectional:\tdown %s, up %s\n",
+				defs.HumanizeSpeed(e.Bidirectional.Download*1000*1000/8, p.useBytes, p.binaryBase),
+				defs.HumanizeSpeed(e.Bidirectional.Upload*1000*1000/8, p.useBytes, p.binaryBase),
+			)
+		case defs.PhaseTuning:
+			p.pb.FinalMSG = fmt.Sprintf(
+				"Tuned requests:\t%d download, %d upload\n",
+				e.Tuning.DownloadRequests,
+				e.Tuning.UploadRequests,
+			)
+		case defs.PhaseResponsiveness:
+			p.pb.FinalMSG = fmt.Sprintf(
+				"Responsiveness:\t%.0f RPM (%s)\n",
+				e.Responsiveness.RPM,
+				e.Responsiveness.Rating,
+			)
+		}
+		if e.Latency != nil {
+			p.pb.FinalMSG += fmt.Sprintf("Loaded ping: %.2f ms\tJitter: %.2f ms\n", e.Latency.Ping, e.Latency.Jitter)
+		}
+		p.pb.Stop()
+		p.pb = nil
+	case defs.EventError:
+		if p.pb != nil {
+			p.pb.Stop()
+			p.pb = nil
 		}
 	}
-	return nil
+}
+
+// updateSpeed shows the last throughput sample next to the spinner
+func (p *spinnerProgress) updateSpeed(s *spinner.Spinner) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	s.Suffix = fmt.Sprintf("  %s", defs.HumanizeSpeed(p.speed, p.useBytes, p.binaryBase))
+}
+
+// updateBidirectionalSpeed shows the last throughput samples of both directions next to the spinner
+func (p *spinnerProgress) updateBidirectionalSpeed(s *spinner.Spinner) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	s.Suffix = fmt.Sprintf(
+		"  down %s, up %s",
+		defs.HumanizeSpeed(p.speed, p.useBytes, p.binaryBase),
+		defs.HumanizeSpeed(p.uploadSpeed, p.useBytes, p.binaryBase),
+	)
 }
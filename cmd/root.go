@@ -5,8 +5,10 @@ Copyright © 2023 NAME HERE <EMAIL ADDRESS>
 import (
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"strings"
 	"time"
 
@@ -58,9 +60,54 @@ type CLIOptions struct {
 	NoUpload        bool                 `json:"no_upload,omitempty"`
 	Secure          bool                 `json:"secure,omitempty"`
 	TestServer      defs.Server          `json:"test_server,omitempty"`
+	TestServers     []defs.Server        `json:"test_servers,omitempty"`
+	Top             int                  `json:"top,omitempty"`
+	RankProbes      int                  `json:"rank_probes,omitempty"`
+	DistanceWeight  float64              `json:"distance_weight,omitempty"`
+	Nearest         int                  `json:"nearest,omitempty"`
+	Radius          float64              `json:"radius,omitempty"`
+	ListDistance    bool                 `json:"list_distance,omitempty"`
+	RankWorkers     int                  `json:"rank_workers,omitempty"`
+	RankTimeout     time.Duration        `json:"rank_timeout,omitempty"`
+	ServerTimeout   time.Duration        `json:"server_timeout,omitempty"`
+	RankStopAfter   int                  `json:"rank_stop_after,omitempty"`
+	ServerIDs       []int                `json:"server_ids,omitempty"`
+	ExcludeIDs      []int                `json:"exclude_ids,omitempty"`
+	ServerName      string               `json:"server_name,omitempty"`
+	Sponsor         string               `json:"sponsor,omitempty"`
+	ServerJSON      string               `json:"server_json,omitempty"`
+	LocalJSON       string               `json:"local_json,omitempty"`
+	MergeServers    bool                 `json:"merge_servers,omitempty"`
+	ServersTTL      time.Duration        `json:"servers_ttl,omitempty"`
+	RefreshServers  bool                 `json:"refresh_servers,omitempty"`
+	Parallel        bool                 `json:"parallel,omitempty"`
 	Share           bool                 `json:"share,omitempty"`
+	IPInfoFallback  bool                 `json:"ipinfo_fallback,omitempty"`
+	IPInfoToken     string               `json:"-"`
+	Privacy         bool                 `json:"privacy,omitempty"`
+	Geo             string               `json:"geo,omitempty"`
+	GeoDB           []string             `json:"geo_db,omitempty"`
 	SkipCertVerify  bool                 `json:"skip_cert_verify,omitempty"`
 	SourceIP        string               `json:"source_ip,omitempty"`
+	Interface       string               `json:"interface,omitempty"`
+	IPv4            bool                 `json:"ipv4,omitempty"`
+	IPv6            bool                 `json:"ipv6,omitempty"`
+	DualStack       bool                 `json:"dual_stack,omitempty"`
+	LoadedLatency   bool                 `json:"loaded_latency,omitempty"`
+	LatencyInterval int                  `json:"latency_interval,omitempty"`
+	Responsiveness  bool                 `json:"responsiveness,omitempty"`
+	SampleInterval  int                  `json:"sample_interval,omitempty"`
+	Warmup          time.Duration        `json:"warmup,omitempty"`
+	Aggregation     string               `json:"aggregation,omitempty"`
+	AutoTune        bool                 `json:"auto_tune,omitempty"`
+	Bidirectional   bool                 `json:"bidirectional,omitempty"`
+	EarlyStop       bool                 `json:"early_stop,omitempty"`
+	StableTolerance float64              `json:"stable_tolerance,omitempty"`
+	StableWindow    time.Duration        `json:"stable_window,omitempty"`
+	MinDuration     time.Duration        `json:"min_duration,omitempty"`
+	Timeout         int                  `json:"timeout,omitempty"`
+	Proxy           string               `json:"proxy,omitempty"`
+	TelemetryJSON   string               `json:"telemetry_json,omitempty"`
 	TelemetryServer defs.TelemetryServer `json:"telemetry_server"`
 	TelemetryExtra  string               `json:"telemetry_extra,omitempty"`
 	UploadSize      int                  `json:"upload_size"`
@@ -68,6 +115,9 @@ type CLIOptions struct {
 	ForceHTTPS      bool                 `json:"force_https,omitempty"`
 	ServerList      []defs.Server        `json:"server_list,omitempty"`
 	LogVerbosity    int                  `json:"-"`
+
+	client *http.Client
+	geo    defs.GeoProvider
 }
 
 func (cliOpts *CLIOptions) Complete(args []string) error {
@@ -93,6 +143,45 @@ func (cliOpts *CLIOptions) Complete(args []string) error {
 			"allowed": printKeys,
 		}).Fatal("Invalid Argument")
 	}
+	if cliOpts.Top < 1 {
+		return errors.New("--top has to be at least 1")
+	}
+	if cliOpts.Nearest < 0 || cliOpts.Radius < 0 {
+		return errors.New("--nearest and --radius can not be negative")
+	}
+	if cliOpts.Geo == "" && len(cliOpts.GeoDB) > 0 {
+		cliOpts.Geo = "mmdb"
+	}
+	switch cliOpts.Geo {
+	case "", "ipinfo", "backend":
+	case "mmdb":
+		if len(cliOpts.GeoDB) == 0 {
+			return errors.New("--geo mmdb needs the database files given by --geo-db")
+		}
+	default:
+		return fmt.Errorf("unknown geolocation provider %q, use 'ipinfo', 'backend' or 'mmdb'", cliOpts.Geo)
+	}
+	if err := cliOpts.loadTelemetryServer(); err != nil {
+		return err
+	}
+	if cliOpts.Privacy && (cliOpts.Geo == "ipinfo" || cliOpts.Geo == "backend" || cliOpts.IPInfoToken != "" || cliOpts.IPInfoFallback) {
+		return errors.New("--privacy only allows the local --geo mmdb provider and no ipinfo.io lookups")
+	}
+	if cliOpts.IPv4 && cliOpts.IPv6 {
+		return errors.New("--ipv4 and --ipv6 can not be used together, use --dual-stack to test both")
+	}
+	if cliOpts.DualStack && (cliOpts.IPv4 || cliOpts.IPv6) {
+		return errors.New("--dual-stack can not be combined with --ipv4 or --ipv6")
+	}
+	if cliOpts.EarlyStop && cliOpts.StableTolerance <= 0 {
+		return errors.New("--stable-tolerance has to be positive")
+	}
+	if _, err := defs.ParseAggregation(cliOpts.Aggregation); err != nil {
+		return err
+	}
+	if cliOpts.Responsiveness && cliOpts.NoDownload && cliOpts.NoUpload {
+		return errors.New("--responsiveness needs the download or the upload to load the connection")
+	}
 	return nil
 }
 
@@ -101,6 +190,7 @@ func (cliOpts *CLIOptions) Run(
 	out io.Writer,
 ) error {
 	log.SetLevel(log.Level(3 + cliOpts.LogVerbosity))
+	ctx := cmd.Context()
 
 	// Print CSV header and exit
 	header, err := cmd.Flags().GetBool("csv-header")
@@ -129,19 +219,44 @@ func (cliOpts *CLIOptions) Run(
 		return nil
 	}
 
+	filter, err := cliOpts.serverFilter()
+	if err != nil {
+		return err
+	}
+	// every server picked by ID is tested unless --top says otherwise
+	if len(cliOpts.ServerIDs) > 0 && !cmd.Flags().Changed("top") {
+		cliOpts.Top = len(cliOpts.ServerIDs)
+	}
+
+	clientOpts := cliOpts.clientOptions()
+	sourceIP, err := speedtest.ResolveSourceIP(clientOpts.SourceIP, clientOpts.Interface, clientOpts.IPVersion)
+	if err != nil {
+		return err
+	}
+	if cliOpts.client, err = speedtest.NewHTTPClient(clientOpts); err != nil {
+		log.Error("Unable to set up the HTTP client")
+		return err
+	}
+
 	// Fetch server list
-	log.Info("Fetching server list")
-	var defaultServerList *[]defs.Server
-	if defaultServerList, err = speedtest.FetchServerList(speedtest.ServerListUrl); err != nil {
-		log.WithField("url", speedtest.ServerListUrl).
-			Error("Unable to fetch remote server list")
+	if err = cliOpts.loadServerList(ctx); err != nil {
+		return err
+	}
+	if err = speedtest.PreprocessServers(&cliOpts.ServerList, cliOpts.ForceHTTPS, cliOpts.NoICMP); err != nil {
+		log.Error("Unable to preprocess server list")
+		return err
+	}
+	if cliOpts.ServerList, err = speedtest.FilterServers(cliOpts.ServerList, filter); err != nil {
 		return err
-	} else {
-		cliOpts.ServerList = append(cliOpts.ServerList, (*defaultServerList)...)
-		if err = speedtest.PreprocessServers(&cliOpts.ServerList, cliOpts.ForceHTTPS, cliOpts.NoICMP); err != nil {
-			log.Error("Unable to preprocess server list")
-			return err
-		}
+	}
+	if cliOpts.geo, err = cliOpts.geoProvider(); err != nil {
+		return err
+	}
+	for i := range cliOpts.ServerList {
+		cliOpts.ServerList[i].HTTPClient = cliOpts.client
+		cliOpts.ServerList[i].SourceIP = sourceIP
+		cliOpts.ServerList[i].IPVersion = clientOpts.IPVersion
+		cliOpts.ServerList[i].Geo = cliOpts.geo
 	}
 
 	// Print Server List and exit
@@ -149,49 +264,87 @@ func (cliOpts *CLIOptions) Run(
 	if err != nil {
 		return err
 	} else if list {
-		for _, server := range cliOpts.ServerList {
-			fmt.Fprintln(out, server)
+		log.Info("Ranking the servers")
+		ranked, err := cliOpts.rankServers(ctx, cliOpts.ListDistance)
+		if err != nil {
+			return err
 		}
-		return nil
+		return printRankedServers(out, ranked, cliOpts.DistanceUnit)
 	}
 
 	// using verbose output for humans
 	if cliOpts.Format == "human-readable" {
-		if err = verboseSpeedTest(cliOpts); err != nil {
+		if err = verboseSpeedTest(ctx, cliOpts); err != nil {
 			return err
 		}
 		return nil
 	}
 
-	log.Info("Selecting the fastest server based on ping")
-	var testServer defs.Server
-	if testServer, err = speedtest.RankServers(&cliOpts.ServerList); err != nil {
+	log.Info("Selecting the fastest servers based on ping")
+	if cliOpts.TestServers, err = cliOpts.topServers(ctx); err != nil {
 		return err
 	}
+	cliOpts.TestServer = cliOpts.TestServers[0]
 	log.Info("Starting the speed test")
-	report, err := speedtest.SingleSpeedTest(
-		&testServer,
-		cliOpts.NoDownload,
-		cliOpts.NoUpload,
-		speedtest.DefaultPingCount,
-		cliOpts.DistanceUnit,
-		cliOpts.Concurrent,
-		cliOpts.Chunks,
-		cliOpts.NoPreAllocate,
-		cliOpts.UploadSize,
-		time.Duration(cliOpts.Duration)*time.Second,
-		!cliOpts.Share,
+	reports, summary, err := speedtest.MultiSpeedTest(
+		ctx,
+		cliOpts.TestServers,
+		cliOpts.speedtestOptions(),
+		cliOpts.Parallel,
 	)
+	if err != nil {
+		return err
+	}
+	if len(cliOpts.TestServers) == 1 {
+		summary = nil
+	}
+
+	cliOpts.printReports(reports, summary)
+	return nil
+}
 
+// printReports prints the reports in the selected format, one per tested server. The summary of a
+// multi-server test is left out by the formats that only hold rows
+func (cliOpts *CLIOptions) printReports(reports []defs.Report, summary *defs.Summary) {
 	if cliOpts.Format == "simple" {
-		fmt.Printf(`Ping:   %.2f ms Jitter: %.2f ms
+		for _, report := range reports {
+			if len(reports) > 1 {
+				fmt.Printf("Server: %s [%s]\n", report.Server.Name, report.Server.Server)
+			}
+			stackReports := report.StackReports()
+			for _, rep := range stackReports {
+				if len(stackReports) > 1 {
+					fmt.Printf("IPv%d:\n", rep.IPVersion)
+				}
+				fmt.Printf(`Ping:   %.2f ms Jitter: %.2f ms
 Download rate:  %.2f Mbps
 Upload rate:    %.2f Mbps
-`, report.Ping, report.Jitter, report.Download, report.Upload)
+`, rep.Ping, rep.Jitter, rep.Download, rep.Upload)
+				if rep.DownloadLatency != nil {
+					fmt.Printf("Download latency:  %.2f ms Jitter: %.2f ms\n", rep.DownloadLatency.Ping, rep.DownloadLatency.Jitter)
+				}
+				if rep.UploadLatency != nil {
+					fmt.Printf("Upload latency:    %.2f ms Jitter: %.2f ms\n", rep.UploadLatency.Ping, rep.UploadLatency.Jitter)
+				}
+				if rep.Bidirectional != nil {
+					fmt.Printf("Bidirectional:     %.2f Mbps down, %.2f Mbps up\n", rep.Bidirectional.Download, rep.Bidirectional.Upload)
+					if rep.Bidirectional.Latency != nil {
+						fmt.Printf("Bidirectional latency: %.2f ms Jitter: %.2f ms\n", rep.Bidirectional.Latency.Ping, rep.Bidirectional.Latency.Jitter)
+					}
+				}
+				if rep.Bufferbloat != "" {
+					fmt.Printf("Bufferbloat grade: %s\n", rep.Bufferbloat)
+				}
+				if rep.Responsiveness != nil {
+					fmt.Printf("Responsiveness:    %.0f RPM (%s)\n", rep.Responsiveness.RPM, rep.Responsiveness.Rating)
+				}
+			}
+		}
+		if summary != nil {
+			printSummary(summary)
+		}
 	} else if cliOpts.Format == "csv" {
-		flatReport := report.GetFlatReport()
-		reportSlice := make([]defs.FlatReport, 1)
-		reportSlice[0] = flatReport
+		reportSlice := flatReports(reports)
 		if resultStrig, err := gocsv.MarshalStringWithoutHeaders(&reportSlice); err != nil {
 			log.Errorf("Error generating CSV report: %s", err)
 		} else {
@@ -204,9 +357,7 @@ Upload rate:    %.2f Mbps
 			writer.Comma = '\t'
 			return gocsv.NewSafeCSVWriter(writer)
 		})
-		flatReport := report.GetFlatReport()
-		reportSlice := make([]defs.FlatReport, 1)
-		reportSlice[0] = flatReport
+		reportSlice := flatReports(reports)
 		if resultStrig, err := gocsv.MarshalStringWithoutHeaders(&reportSlice); err != nil {
 			log.Errorf("Error generating CSV report: %s", err)
 		} else {
@@ -214,39 +365,29 @@ Upload rate:    %.2f Mbps
 		}
 
 	} else if cliOpts.Format == "json" {
-		reportSlice := make([]defs.Report, 1)
-		reportSlice[0] = *report
-		if jsonBytes, err := json.Marshal(&reportSlice); err != nil {
+		if jsonBytes, err := json.Marshal(jsonOutput(reports, summary)); err != nil {
 			log.Errorf("Error generating JSON report: %s", err)
 		} else {
 			fmt.Println(string(jsonBytes))
 		}
 
 	} else if cliOpts.Format == "jsonl" {
-		reportSlice := make([]defs.Report, 2)
-		reportSlice[0] = *report
-		var output string
-		for _, rep := range reportSlice {
+		for _, rep := range reports {
 			if jsonBytes, err := json.Marshal(&rep); err != nil {
 				log.Errorf("Error generating JSON report: %s", err)
 			} else {
-				output = fmt.Sprintf("%s\n%s", output, string(jsonBytes))
+				fmt.Println(string(jsonBytes))
 			}
 		}
-		fmt.Println(output)
 
 	} else if cliOpts.Format == "json-pretty" {
-		reportSlice := make([]defs.Report, 1)
-		reportSlice[0] = *report
-		if jsonBytes, err := json.MarshalIndent(&reportSlice, "", "  "); err != nil {
+		if jsonBytes, err := json.MarshalIndent(jsonOutput(reports, summary), "", "  "); err != nil {
 			log.Errorf("Error generating JSON report: %s", err)
 		} else {
 			fmt.Println(string(jsonBytes))
 		}
 
 	}
-
-	return nil
 }
 
 func (cliOpts *CLIOptions) CobraCommand() *cobra.Command {
@@ -267,9 +408,139 @@ librespeed.org	Copyright (C)`, defs.ProgName, defs.ProgVersion, defs.BuildDate)
 	}
 	f := cmd.Flags()
 
-	f.BoolP("list", "l", false, "Display a list of LibreSpeed.org servers")
+	f.BoolP("list", "l", false, "Display the LibreSpeed.org servers ranked by their score")
+	f.BoolVar(
+		&cliOpts.ListDistance,
+		"list-distance",
+		false,
+		`Show the distance of the servers in --list, looks up your location
+	and the location of every server`,
+	)
 	f.Bool("csv-header", false, "Print CSV headers")
 	f.Bool("tsv-header", false, "Print TSV headers")
+	f.StringVar(
+		&cliOpts.ServerJSON,
+		"server-json",
+		"",
+		`Use an alternative server list from a JSON file,
+	given as an http(s) URL or a local path`,
+	)
+	f.StringVar(
+		&cliOpts.LocalJSON,
+		"local-json",
+		"",
+		"Use an alternative server list from a local JSON file",
+	)
+	f.BoolVar(
+		&cliOpts.MergeServers,
+		"merge-servers",
+		false,
+		`Add the servers from --server-json and --local-json to the
+	LibreSpeed.org list instead of replacing it`,
+	)
+	f.DurationVar(
+		&cliOpts.ServersTTL,
+		"servers-ttl",
+		speedtest.DefaultServerListTTL,
+		`How long a cached remote server list is used before
+	checking it for changes`,
+	)
+	f.BoolVar(
+		&cliOpts.RefreshServers,
+		"refresh-servers",
+		false,
+		"Fetch the remote server lists again instead of using the cache",
+	)
+	f.IntSliceVar(
+		&cliOpts.ServerIDs,
+		"server",
+		nil,
+		`Test only the servers with the given IDs, can be repeated
+	or comma separated. See --list for the IDs`,
+	)
+	f.IntSliceVar(
+		&cliOpts.ExcludeIDs,
+		"exclude",
+		nil,
+		"Exclude the servers with the given IDs, can be repeated or comma separated",
+	)
+	f.StringVar(
+		&cliOpts.ServerName,
+		"server-name",
+		"",
+		"Test only the servers whose name matches the regular expression",
+	)
+	f.StringVar(
+		&cliOpts.Sponsor,
+		"sponsor",
+		"",
+		"Test only the servers whose sponsor matches the regular expression",
+	)
+	f.IntVar(
+		&cliOpts.Top,
+		"top",
+		1,
+		`Test the N fastest servers based on ping,
+	defaults to all the servers given by --server`,
+	)
+	f.IntVar(
+		&cliOpts.RankProbes,
+		"rank-probes",
+		speedtest.DefaultRankProbes,
+		"Number of latency probes sent to every server when ranking them",
+	)
+	f.Float64Var(
+		&cliOpts.DistanceWeight,
+		"rank-distance-weight",
+		0,
+		`Milliseconds added to a server's ranking score per 1000 km
+	between you and the server, looks up the location of every server`,
+	)
+	f.IntVar(
+		&cliOpts.Nearest,
+		"nearest",
+		0,
+		`Only probe the N servers nearest to you when ranking them,
+	looks up the location of every server`,
+	)
+	f.Float64Var(
+		&cliOpts.Radius,
+		"radius",
+		0,
+		`Only probe the servers within this distance from you when
+	ranking them, in the unit set by --distance`,
+	)
+	f.IntVar(
+		&cliOpts.RankWorkers,
+		"rank-workers",
+		speedtest.DefaultRankWorkers,
+		"Number of servers probed at the same time when ranking them",
+	)
+	f.DurationVar(
+		&cliOpts.RankTimeout,
+		"rank-timeout",
+		speedtest.DefaultRankTimeout,
+		"Time limit for ranking all the servers",
+	)
+	f.DurationVar(
+		&cliOpts.ServerTimeout,
+		"server-timeout",
+		speedtest.DefaultRankServerTimeout,
+		"Time limit for probing a single server when ranking them",
+	)
+	f.IntVar(
+		&cliOpts.RankStopAfter,
+		"rank-stop-after",
+		0,
+		`Stop ranking once this many servers answered and pick
+	the best of them, 0 probes every server`,
+	)
+	f.BoolVar(
+		&cliOpts.Parallel,
+		"parallel",
+		false,
+		"Test the servers selected by --top at the same time",
+	)
 	f.StringVarP(
 		&cliOpts.Format,
 		"format",
@@ -299,6 +570,48 @@ librespeed.org	Copyright (C)`, defs.ProgName, defs.ProgVersion, defs.BuildDate)
 		`Use HTTPS instead of HTTP when communicating with
 	LibreSpeed.org operated servers`,
 	)
+	f.BoolVar(
+		&cliOpts.SkipCertVerify,
+		"skip-cert-verify",
+		false,
+		"Skip verifying SSL certificate for HTTPS connections (self-signed certs)",
+	)
+	f.StringVar(
+		&cliOpts.SourceIP,
+		"source",
+		"",
+		"Source IP address to bind to",
+	)
+	f.StringVar(
+		&cliOpts.Interface,
+		"interface",
+		"",
+		`Network interface to bind to, its first address is used.
+	Can not be used together with --source`,
+	)
+	f.BoolVarP(&cliOpts.IPv4, "ipv4", "4", false, "Force IPv4 only")
+	f.BoolVarP(&cliOpts.IPv6, "ipv6", "6", false, "Force IPv6 only")
+	f.BoolVar(
+		&cliOpts.DualStack,
+		"dual-stack",
+		false,
+		`Run the whole test over IPv4 and then over IPv6 against
+	the same server and report both results`,
+	)
+	f.IntVar(
+		&cliOpts.Timeout,
+		"timeout",
+		15,
+		`Timeout in seconds for connecting to a server and for its response
+	to start, 0 disables the timeout`,
+	)
+	f.StringVar(
+		&cliOpts.Proxy,
+		"proxy",
+		"",
+		`Proxy URL for all HTTP requests, the HTTP_PROXY and HTTPS_PROXY
+	environment variables are used when not given`,
+	)
 	f.BoolVar(
 		&cliOpts.NoPreAllocate,
 		"no-pre-allocate",
@@ -347,6 +660,42 @@ librespeed.org	Copyright (C)`, defs.ProgName, defs.ProgVersion, defs.BuildDate)
 		`Change distance unit shown in ISP info, use 'mi' for miles,
 	'km' for kilometres, 'NM' for nautical miles`,
 	)
+	f.StringVar(
+		&cliOpts.Geo,
+		"geo",
+		"",
+		`Geolocation provider used for you and the servers, 'ipinfo',
+	'backend' (the server's getIP endpoint for you, ipinfo.io for the
+	servers) or 'mmdb' (local MaxMind DB files), servers are located
+	on ipinfo.io when not set`,
+	)
+	f.StringSliceVar(
+		&cliOpts.GeoDB,
+		"geo-db",
+		nil,
+		`GeoLite2 or DB-IP MaxMind DB files used by --geo mmdb, such as
+	a City and an ASN database`,
+	)
+	f.StringVar(
+		&cliOpts.IPInfoToken,
+		"ipinfo-token",
+		"",
+		"API token for ipinfo.io",
+	)
+	f.BoolVar(
+		&cliOpts.Privacy,
+		"privacy",
+		false,
+		`Skip every external geolocation lookup, mask your IP address and
+	host name in the results and only share the throughput`,
+	)
+	f.BoolVar(
+		&cliOpts.IPInfoFallback,
+		"ipinfo-fallback",
+		false,
+		`Look your ISP info up on ipinfo.io when the server's getIP
+	endpoint fails`,
+	)
 	f.IntVarP(
 		&cliOpts.Duration,
 		"duration",
@@ -354,6 +703,87 @@ librespeed.org	Copyright (C)`, defs.ProgName, defs.ProgVersion, defs.BuildDate)
 		15,
 		"Upload and download test duration in seconds",
 	)
+	f.BoolVar(
+		&cliOpts.Bidirectional,
+		"bidirectional",
+		false,
+		`Also download and upload at the same time after the upload test,
+	runs even with --no-download and --no-upload`,
+	)
+	f.BoolVar(
+		&cliOpts.AutoTune,
+		"auto-tune",
+		false,
+		`Probe the link before the tests and pick the number of
+	concurrent requests, chunks and upload size automatically`,
+	)
+	f.BoolVar(
+		&cliOpts.EarlyStop,
+		"early-stop",
+		false,
+		`Stop the upload and download tests as soon as the speed is stable,
+	--duration becomes the maximum test duration`,
+	)
+	f.Float64Var(
+		&cliOpts.StableTolerance,
+		"stable-tolerance",
+		defs.DefaultStableTolerance*100,
+		"Percentage the speed may vary by and still be considered stable",
+	)
+	f.DurationVar(
+		&cliOpts.StableWindow,
+		"stable-window",
+		defs.DefaultStableWindow,
+		"How long the speed has to be stable for the test to stop early",
+	)
+	f.DurationVar(
+		&cliOpts.MinDuration,
+		"min-duration",
+		defs.DefaultMinDuration,
+		"Minimum test duration when stopping early",
+	)
+	f.BoolVar(
+		&cliOpts.LoadedLatency,
+		"loaded-latency",
+		false,
+		`Measure the latency while downloading and uploading
+	and grade the bufferbloat of the connection`,
+	)
+	f.IntVar(
+		&cliOpts.LatencyInterval,
+		"latency-interval",
+		int(defs.DefaultLatencyInterval/time.Millisecond),
+		"Interval in milliseconds between loaded latency probes",
+	)
+	f.DurationVar(
+		&cliOpts.Warmup,
+		"warmup",
+		0,
+		`Grace period at the start of the download and upload tests
+	whose bytes are not counted, e.g. 2s`,
+	)
+	f.StringVar(
+		&cliOpts.Aggregation,
+		"aggregation",
+		string(defs.AggregationMean),
+		`How the speed is calculated from the throughput samples:
+	'mean', 'trimmed' (mean without the fastest and slowest 10%)
+	or 'window' (fastest speed sustained for 2 seconds)`,
+	)
+	f.IntVar(
+		&cliOpts.SampleInterval,
+		"sample-interval",
+		int(defs.DefaultSampleInterval/time.Millisecond),
+		`Interval in milliseconds between the throughput samples
+	recorded in the JSON report`,
+	)
+	f.BoolVar(
+		&cliOpts.Responsiveness,
+		"responsiveness",
+		false,
+		`Measure the responsiveness of the saturated connection
+	in round trips per minute (RPM)`,
+	)
 	f.IntVarP(
 		&cliOpts.UploadSize,
 		"upload-size",
@@ -374,6 +804,46 @@ librespeed.org	Copyright (C)`, defs.ProgName, defs.ProgVersion, defs.BuildDate)
 		`Generate and provide a URL to the LibreSpeed.org share results
 image, not displayed with csv and tsv formats.`,
 	)
+	f.StringVar(
+		&cliOpts.TelemetryJSON,
+		"telemetry-json",
+		"",
+		`Load the telemetry server settings from a JSON file, with the
+	telemetryLevel, server, path and shareURL keys`,
+	)
+	f.StringVar(
+		&cliOpts.TelemetryServer.Level,
+		"telemetry-level",
+		"",
+		`Telemetry level: 'disabled', 'basic', 'full' or 'debug', the log
+	of the test is shared with 'full' and 'debug' (default "`+speedtest.DefaultTelemetryLevel+`")`,
+	)
+	f.StringVar(
+		&cliOpts.TelemetryServer.Server,
+		"telemetry-server",
+		"",
+		"Telemetry server base URL (default \""+speedtest.DefaultTelemetryServer+"\")",
+	)
+	f.StringVar(
+		&cliOpts.TelemetryServer.Path,
+		"telemetry-path",
+		"",
+		"Telemetry upload path (default \""+speedtest.DefaultTelemetryPath+"\")",
+	)
+	f.StringVar(
+		&cliOpts.TelemetryServer.Share,
+		"telemetry-share",
+		"",
+		"Telemetry share page path (default \""+speedtest.DefaultTelemetryShare+"\")",
+	)
+	f.StringVar(
+		&cliOpts.TelemetryExtra,
+		"telemetry-extra",
+		"",
+		"Extra data sent along with the telemetry",
+	)
+
+	cmd.AddCommand((&ServeOptions{}).CobraCommand())
 
 	cmd.RunE = func(cmd *cobra.Command, args []string) (err error) {
 		if err := cliOpts.Complete(args); err != nil {
@@ -0,0 +1,222 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/czechbol/librespeedtest/backend"
+	"github.com/czechbol/librespeedtest/defs"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	serveUse   = "serve"
+	serveShort = "Run a LibreSpeed compatible speed test server"
+	serveLong  = `Run a LibreSpeed compatible speed test server.
+
+It serves the garbage, empty and getIP endpoints at the paths of the PHP backend,
+so a server list entry for it looks like:
+
+  {"id": 1, "name": "Office", "server": "http://host:8989/",
+   "dlURL": "garbage.php", "ulURL": "empty.php",
+   "pingURL": "empty.php", "getIpURL": "getIP.php"}`
+)
+
+// ServeOptions holds the options of the serve subcommand
+type ServeOptions struct {
+	Listen       string
+	ChunkSize    int
+	MaxChunks    int
+	TLSCert      string
+	TLSKey       string
+	RateLimit    float64
+	RateBurst    int
+	TrustProxy   bool
+	GeoDB        []string
+	Location     string
+	Results      bool
+	ResultsDB    string
+	ResultsMax   int
+	ResultsToken string
+	LogVerbosity int
+}
+
+func (serveOpts *ServeOptions) Complete(args []string) error {
+	if (serveOpts.TLSCert == "") != (serveOpts.TLSKey == "") {
+		return errors.New("--tls-cert and --tls-key have to be used together")
+	}
+	if serveOpts.ChunkSize <= 0 || serveOpts.MaxChunks <= 0 {
+		return errors.New("--chunk-size and --max-chunks have to be positive")
+	}
+	if serveOpts.RateLimit < 0 || serveOpts.RateBurst < 0 {
+		return errors.New("--rate-limit and --rate-burst can not be negative")
+	}
+	if serveOpts.ResultsMax <= 0 {
+		return errors.New("--results-max has to be positive")
+	}
+	if serveOpts.Location != "" {
+		if _, err := defs.DistanceKm(serveOpts.Location, serveOpts.Location); err != nil {
+			return fmt.Errorf("invalid --location %q, use \"latitude,longitude\"", serveOpts.Location)
+		}
+	}
+	return nil
+}
+
+func (serveOpts *ServeOptions) Run(cmd *cobra.Command) error {
+	log.SetLevel(log.Level(4 + serveOpts.LogVerbosity))
+
+	config := backend.Config{
+		ChunkSize:    serveOpts.ChunkSize * 1024,
+		MaxChunks:    serveOpts.MaxChunks,
+		RateLimit:    serveOpts.RateLimit,
+		RateBurst:    serveOpts.RateBurst,
+		TrustProxy:   serveOpts.TrustProxy,
+		Location:     serveOpts.Location,
+		ResultsToken: serveOpts.ResultsToken,
+	}
+	if len(serveOpts.GeoDB) > 0 {
+		geo, err := defs.OpenMMDB(serveOpts.GeoDB...)
+		if err != nil {
+			return err
+		}
+		config.Geo = geo
+	}
+	if serveOpts.ResultsDB != "" {
+		store, err := backend.OpenFileStore(serveOpts.ResultsDB, serveOpts.ResultsMax)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		config.Results = store
+	} else if serveOpts.Results {
+		config.Results = &backend.MemoryStore{Max: serveOpts.ResultsMax}
+	}
+
+	server, err := backend.New(config)
+	if err != nil {
+		return err
+	}
+	scheme := "http"
+	if serveOpts.TLSCert != "" {
+		scheme = "https"
+	}
+	log.Infof("Serving the speed test backend at %s://%s", scheme, serveOpts.Listen)
+	return server.ListenAndServe(cmd.Context(), serveOpts.Listen, serveOpts.TLSCert, serveOpts.TLSKey)
+}
+
+func (serveOpts *ServeOptions) CobraCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:           serveUse,
+		Short:         serveShort,
+		Long:          serveLong,
+		Args:          cobra.NoArgs,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	f := cmd.Flags()
+
+	f.StringVar(
+		&serveOpts.Listen,
+		"listen",
+		":8989",
+		"Address to listen on",
+	)
+	f.IntVar(
+		&serveOpts.ChunkSize,
+		"chunk-size",
+		backend.DefaultChunkSize/1024,
+		"Size of a chunk of the download payload in KiB",
+	)
+	f.IntVar(
+		&serveOpts.MaxChunks,
+		"max-chunks",
+		backend.DefaultMaxChunks,
+		"Maximum number of chunks sent for a single download request",
+	)
+	f.StringVar(
+		&serveOpts.TLSCert,
+		"tls-cert",
+		"",
+		"TLS certificate file, serves HTTPS together with --tls-key",
+	)
+	f.StringVar(
+		&serveOpts.TLSKey,
+		"tls-key",
+		"",
+		"TLS private key file",
+	)
+	f.Float64Var(
+		&serveOpts.RateLimit,
+		"rate-limit",
+		0,
+		"Requests per second allowed for every client, 0 disables the limit",
+	)
+	f.IntVar(
+		&serveOpts.RateBurst,
+		"rate-burst",
+		0,
+		`Requests a client may make at once before the rate limit applies,
+	defaults to the rate limit`,
+	)
+	f.BoolVar(
+		&serveOpts.TrustProxy,
+		"trust-proxy",
+		false,
+		"Take the client's address from the X-Real-IP and X-Forwarded-For headers",
+	)
+	f.StringSliceVar(
+		&serveOpts.GeoDB,
+		"geo-db",
+		nil,
+		"MaxMind DB files the ISP info returned by getIP is looked up in",
+	)
+	f.StringVar(
+		&serveOpts.Location,
+		"location",
+		"",
+		`Location of the server as "latitude,longitude", getIP tells
+	the client's distance from it`,
+	)
+	f.BoolVar(
+		&serveOpts.Results,
+		"results",
+		false,
+		`Accept shared results at results/telemetry.php and serve their
+	share pages at results/?id=ID, the results are kept in memory
+	unless --results-db is set`,
+	)
+	f.StringVar(
+		&serveOpts.ResultsDB,
+		"results-db",
+		"",
+		"File the shared results are stored in, implies --results",
+	)
+	f.IntVar(
+		&serveOpts.ResultsMax,
+		"results-max",
+		backend.DefaultMaxResults,
+		"Maximum number of stored results, the oldest ones are dropped first",
+	)
+	f.StringVar(
+		&serveOpts.ResultsToken,
+		"results-token",
+		"",
+		`Token the JSON listing of the results at results/json requires,
+	as a bearer token or with ?token=, the listing is disabled when empty`,
+	)
+	f.CountVarP(
+		&serveOpts.LogVerbosity,
+		"verbose",
+		"v",
+		"Logging verbosity. Specify multiple times for higher verbosity",
+	)
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if err := serveOpts.Complete(args); err != nil {
+			return err
+		}
+		return serveOpts.Run(cmd)
+	}
+	return cmd
+}
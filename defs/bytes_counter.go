@@ -20,8 +20,16 @@ type BytesCounter struct {
 	reader     io.ReadSeeker
 	binaryBase bool
 	uploadSize int
+	samples    []ThroughputSample
 
-	lock *sync.Mutex
+	// warmupEnd and warmupBytes mark the end of the warmup, whose bytes aren't part of the average
+	warmup      time.Duration
+	warmupEnd   time.Time
+	warmupBytes int
+
+	lock         *sync.Mutex
+	stopSampling chan struct{}
+	samplingDone chan struct{}
 }
 
 func NewCounter() *BytesCounter {
@@ -40,10 +48,10 @@ func (c *BytesCounter) Write(p []byte) (int, error) {
 	return n, nil
 }
 
-// Read implements io.Reader
+// Read implements io.Reader. Concurrent requests share the reader, so it is read under the lock
 func (c *BytesCounter) Read(p []byte) (int, error) {
-	n, err := c.reader.Read(p)
 	c.lock.Lock()
+	n, err := c.reader.Read(p)
 	c.total += n
 	c.pos += n
 	if c.pos == c.uploadSize {
@@ -64,9 +72,16 @@ func (c *BytesCounter) SetUploadSize(uploadSize int) {
 	c.uploadSize = uploadSize * 1024
 }
 
-// AvgBytes returns the average bytes/second
+// AvgBytes returns the average bytes/second, leaving out the warmup
 func (c *BytesCounter) AvgBytes() float64 {
-	return float64(c.total) / time.Now().Sub(c.start).Seconds()
+	c.lock.Lock()
+	start, total := c.start, c.total
+	if !c.warmupEnd.IsZero() {
+		start, total = c.warmupEnd, c.total-c.warmupBytes
+	}
+	c.lock.Unlock()
+
+	return float64(total) / time.Now().Sub(start).Seconds()
 }
 
 // AvgBits returns the average bits/second
@@ -82,13 +97,20 @@ func (c *BytesCounter) AvgMbps() float64 {
 
 // AvgHumanize returns the average bytes/kilobytes/megabytes/gigabytes (or bytes/kibibytes/mebibytes/gibibytes) per second
 func (c *BytesCounter) AvgHumanize(bytes bool) string {
-	val := c.AvgBits()
+	return HumanizeSpeed(c.AvgBytes(), bytes, c.binaryBase)
+}
+
+// HumanizeSpeed formats a speed given in bytes/second as bits/kilobits/megabits/gigabits per second,
+// or as bytes/kilobytes/megabytes/gigabytes per second when `bytes` is set. `binaryBase` switches
+// to the binary prefixes (kibi, mebi, gibi)
+func HumanizeSpeed(bytesPerSecond float64, bytes bool, binaryBase bool) string {
+	val := bytesPerSecond * 8
 	if bytes {
-		val = c.AvgBytes()
+		val = bytesPerSecond
 	}
 
 	var base float64 = 1000
-	if c.binaryBase && bytes {
+	if binaryBase && bytes {
 		base = 1024
 		if val < base {
 			return fmt.Sprintf("%.2f bytes/s", val)
@@ -99,7 +121,7 @@ func (c *BytesCounter) AvgHumanize(bytes bool) string {
 		} else {
 			return fmt.Sprintf("%.2f GiB/s", val/base/base/base)
 		}
-	} else if c.binaryBase {
+	} else if binaryBase {
 		base = 1024
 		if val < base {
 			return fmt.Sprintf("%.2f bits/s", val)
@@ -146,19 +168,88 @@ func (c *BytesCounter) resetReader() (int64, error) {
 	return c.reader.Seek(0, 0)
 }
 
-// Start will set the `start` field to current time
+// Start will set the `start` field to current time and start the warmup, if set
 func (c *BytesCounter) Start() {
 	c.start = time.Now()
+	if c.warmup > 0 {
+		time.AfterFunc(c.warmup, c.endWarmup)
+	}
+}
+
+// StartSampling records the throughput every interval until StopSampling is called,
+// DefaultSampleInterval is used when interval is not positive
+func (c *BytesCounter) StartSampling(interval time.Duration) {
+	interval = sampleInterval(interval)
+
+	c.stopSampling = make(chan struct{})
+	c.samplingDone = make(chan struct{})
+	go func() {
+		defer close(c.samplingDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		lastTime, lastTotal := c.start, 0
+		for {
+			select {
+			case <-c.stopSampling:
+				return
+			case now := <-ticker.C:
+				c.lock.Lock()
+				sample := ThroughputSample{
+					Time:   now.Sub(c.start).Seconds(),
+					Bytes:  c.total,
+					Speed:  float64(c.total-lastTotal) * 8 / now.Sub(lastTime).Seconds() / 1000 / 1000,
+					Warmup: c.warmup > 0 && c.warmupEnd.IsZero(),
+				}
+				c.samples = append(c.samples, sample)
+				c.lock.Unlock()
+				lastTime, lastTotal = now, sample.Bytes
+			}
+		}
+	}()
+}
+
+// SetWarmup sets the length of the warmup following Start, its bytes are left out of the average speed
+// and its samples are marked as warmup
+func (c *BytesCounter) SetWarmup(warmup time.Duration) {
+	c.warmup = warmup
+}
+
+// endWarmup ends the warmup
+func (c *BytesCounter) endWarmup() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.warmupEnd = time.Now()
+	c.warmupBytes = c.total
+}
+
+// StopSampling stops recording the throughput, the unfinished sample interval is dropped
+func (c *BytesCounter) StopSampling() {
+	if c.stopSampling == nil {
+		return
+	}
+	close(c.stopSampling)
+	<-c.samplingDone
+	c.stopSampling = nil
+}
+
+// Samples returns the throughput samples recorded so far
+func (c *BytesCounter) Samples() []ThroughputSample {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]ThroughputSample(nil), c.samples...)
 }
 
 // Total returns the total bytes read/written
 func (c *BytesCounter) Total() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	return c.total
 }
 
 // CurrentSpeed returns the current bytes/second
 func (c *BytesCounter) CurrentSpeed() float64 {
-	return float64(c.total) / time.Now().Sub(c.start).Seconds()
+	return float64(c.Total()) / time.Now().Sub(c.start).Seconds()
 }
 
 // SeekWrapper is a wrapper around io.Reader to give it a noop io.Seeker interface
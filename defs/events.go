@@ -0,0 +1,113 @@
+package defs
+
+import (
+	"time"
+)
+
+// DefaultEventInterval is the default interval between two throughput samples
+const DefaultEventInterval = 100 * time.Millisecond
+
+// EventType represents the kind of a progress event
+type EventType int
+
+const (
+	// EventPhaseStarted is emitted when a test phase starts
+	EventPhaseStarted EventType = iota
+	// EventPingSample is emitted for every ping response received
+	EventPingSample
+	// EventThroughputSample is emitted periodically while downloading or uploading
+	EventThroughputSample
+	// EventPhaseFinished is emitted when a test phase finishes, carrying its results
+	EventPhaseFinished
+	// EventError is emitted when a test phase fails
+	EventError
+)
+
+// String returns the name of the event type
+func (t EventType) String() string {
+	switch t {
+	case EventPhaseStarted:
+		return "phase_started"
+	case EventPingSample:
+		return "ping_sample"
+	case EventThroughputSample:
+		return "throughput_sample"
+	case EventPhaseFinished:
+		return "phase_finished"
+	case EventError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// Phase represents a single phase of a speed test
+type Phase string
+
+const (
+	PhasePing     Phase = "ping"
+	PhaseDownload Phase = "download"
+	PhaseUpload   Phase = "upload"
+	// PhaseBidirectional runs the download and the upload at the same time, its throughput samples
+	// are emitted with PhaseDownload and PhaseUpload
+	PhaseBidirectional Phase = "bidirectional"
+	// PhaseTuning probes the link for the transfer parameters before the download and the upload
+	PhaseTuning Phase = "tuning"
+	// PhaseResponsiveness measures the round trips per minute of the saturated connection
+	PhaseResponsiveness Phase = "responsiveness"
+)
+
+// Event represents a single progress update of a running speed test
+type Event struct {
+	Type  EventType
+	Phase Phase
+	Time  time.Time
+
+	// Ping is the round trip time of a ping sample, or the average ping once the phase finishes, in milliseconds
+	Ping float64
+	// Jitter is the jitter of the ping phase in milliseconds, only set once the phase finishes
+	Jitter float64
+	// Bytes is the amount of bytes transferred since the phase started
+	Bytes int
+	// Speed is the average transfer speed since the phase started, in bytes/second
+	Speed float64
+	// Latency is the latency measured while transferring, only set once the phase finishes
+	Latency *LatencyStats
+	// Bidirectional holds the results of the bidirectional phase, only set once it finishes
+	Bidirectional *Bidirectional
+	// Tuning holds the parameters picked by the tuning phase, only set once it finishes
+	Tuning *Tuning
+	// Responsiveness holds the results of the responsiveness phase, only set once it finishes
+	Responsiveness *Responsiveness
+	// Err is the error that made the phase fail
+	Err error
+	// Server is the name of the server under test
+	Server string
+	// IPVersion is the address family the test is restricted to, zero when it is not
+	IPVersion int
+}
+
+// EventHandler receives the progress events of a running speed test.
+// HandleEvent is called synchronously from the test goroutines, so it should return quickly.
+type EventHandler interface {
+	HandleEvent(Event)
+}
+
+// EventHandlerFunc is an adapter to allow the use of ordinary functions as an EventHandler
+type EventHandlerFunc func(Event)
+
+// HandleEvent calls f(e)
+func (f EventHandlerFunc) HandleEvent(e Event) {
+	f(e)
+}
+
+// EventChannel returns an EventHandler forwarding events to ch.
+// Events are dropped instead of blocking the test when ch is full.
+func EventChannel(ch chan<- Event) EventHandler {
+	return EventHandlerFunc(func(e Event) {
+		select {
+		case ch <- e:
+		default:
+		}
+	})
+}
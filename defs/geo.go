@@ -0,0 +1,119 @@
+package defs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrAddressRequired is returned by the providers that can't look up the client's own address
+var ErrAddressRequired = errors.New("geolocation provider needs an IP address")
+
+// GeoProvider looks up the location and the network of IP addresses
+type GeoProvider interface {
+	// Lookup returns the information about ip, an empty ip looks up the client's own address
+	Lookup(ctx context.Context, ip string) (*IPInfoResponse, error)
+}
+
+// IPInfoProvider looks addresses up on ipinfo.io
+type IPInfoProvider struct {
+	// Token is the ipinfo.io API token, the unauthenticated rate limit applies when empty
+	Token string
+	// Client is used for the requests, http.DefaultClient is used when nil
+	Client *http.Client
+}
+
+// Lookup implements GeoProvider
+func (p *IPInfoProvider) Lookup(ctx context.Context, ip string) (*IPInfoResponse, error) {
+	query, err := url.JoinPath("https://ipinfo.io/", ip, "/json")
+	if err != nil {
+		log.Debugf("Failed getting IP Info: %s", err)
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, query, nil)
+	if err != nil {
+		log.Debugf("Failed when creating HTTP request: %s", err)
+		return nil, err
+	}
+	if p.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.Token)
+	}
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Debugf("Failed getting IP Info: %s", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ipinfo.io returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Debugf("Failed getting IP Info: %s", err)
+		return nil, err
+	}
+
+	var info IPInfoResponse
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &info); err != nil {
+			log.Debugf("Failed when parsing get IP result: %s", err)
+			log.Debugf("Received payload: %s", body)
+		}
+	}
+	return &info, nil
+}
+
+// BackendProvider looks the client up on the getIP endpoint of a speed test server. The endpoint
+// only knows the client's own address, the other ones, such as the servers', are looked up with Fallback
+type BackendProvider struct {
+	Server *Server
+	// Fallback looks up the addresses other than the client's, ipinfo.io is used when nil
+	Fallback GeoProvider
+}
+
+// Lookup implements GeoProvider
+func (p *BackendProvider) Lookup(ctx context.Context, ip string) (*IPInfoResponse, error) {
+	if ip != "" {
+		fallback := p.Fallback
+		if fallback == nil {
+			fallback = &IPInfoProvider{Client: p.Server.GetHTTPClient()}
+		}
+		return fallback.Lookup(ctx, ip)
+	}
+	// the distance in the processed string isn't used, so the backend isn't asked for it
+	result, err := p.Server.getIP(ctx, url.Values{"isp": {"true"}})
+	if err != nil {
+		return nil, err
+	}
+	return &result.RawISPInfo, nil
+}
+
+// Merge returns info with its empty fields filled in from other
+func (info IPInfoResponse) Merge(other IPInfoResponse) IPInfoResponse {
+	fill := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+	fill(&info.IP, other.IP)
+	fill(&info.Hostname, other.Hostname)
+	fill(&info.City, other.City)
+	fill(&info.Region, other.Region)
+	fill(&info.Country, other.Country)
+	fill(&info.Location, other.Location)
+	fill(&info.Organization, other.Organization)
+	fill(&info.Postal, other.Postal)
+	fill(&info.Timezone, other.Timezone)
+	return info
+}
@@ -0,0 +1,65 @@
+package defs
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// staticGeo looks up the same info for every address
+type staticGeo IPInfoResponse
+
+func (g staticGeo) Lookup(ctx context.Context, ip string) (*IPInfoResponse, error) {
+	info := IPInfoResponse(g)
+	info.IP = ip
+	return &info, nil
+}
+
+func TestBackendProvider(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("isp") != "true" || r.URL.Query().Has("distance") {
+			t.Errorf("getIP was requested with %s", r.URL.RawQuery)
+		}
+		w.Write([]byte(`{"processedString":"203.0.113.7 - AS64500 Example, CZ",` +
+			`"rawIspInfo":{"ip":"203.0.113.7","org":"AS64500 Example","country":"CZ","loc":"50.0,14.0"}}`))
+	}))
+	defer ts.Close()
+
+	p := &BackendProvider{
+		Server:   &Server{Server: ts.URL, GetIPURL: "getIP.php"},
+		Fallback: staticGeo{Country: "AT", Location: "48.2,16.4"},
+	}
+	tests := []struct {
+		name string
+		ip   string
+		want IPInfoResponse
+	}{
+		{"own address", "", IPInfoResponse{IP: "203.0.113.7", Organization: "AS64500 Example", Country: "CZ", Location: "50.0,14.0"}},
+		{"other address", "198.51.100.1", IPInfoResponse{IP: "198.51.100.1", Country: "AT", Location: "48.2,16.4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := p.Lookup(context.Background(), tt.ip)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *info != tt.want {
+				t.Errorf("got %+v, want %+v", *info, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocateWithBackendProvider(t *testing.T) {
+	server := &Server{Server: "http://127.0.0.1:1/", GetIPURL: "getIP.php"}
+	server.Geo = &BackendProvider{Server: server, Fallback: staticGeo{Location: "48.2,16.4"}}
+
+	location, err := server.Locate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location != "48.2,16.4" {
+		t.Errorf("located the server at %q, want the fallback's location", location)
+	}
+}
@@ -0,0 +1,230 @@
+package defs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-ping/ping"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultLatencyInterval is the default interval between latency probes sent while the link is loaded
+const DefaultLatencyInterval = 250 * time.Millisecond
+
+// icmpReplyTimeout is how long the ICMP probes may go unanswered before HTTP is used instead,
+// a firewall filtering ICMP drops the probes without an error
+const icmpReplyTimeout = 2 * time.Second
+
+// LatencyStats represents the latency measured while the link was loaded
+type LatencyStats struct {
+	Ping    float64 `json:"ping"`
+	Jitter  float64 `json:"jitter"`
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+	Samples int     `json:"samples"`
+}
+
+// newLatencyStats calculates the latency statistics from the given round trip times in milliseconds,
+// nil is returned when there are none
+func newLatencyStats(pings []float64) *LatencyStats {
+	if len(pings) == 0 {
+		return nil
+	}
+
+	stats := LatencyStats{
+		Ping:    getAvg(pings),
+		Jitter:  getJitter(pings),
+		Min:     pings[0],
+		Max:     pings[0],
+		Samples: len(pings),
+	}
+	for _, p := range pings {
+		stats.Min = math.Min(stats.Min, p)
+		stats.Max = math.Max(stats.Max, p)
+	}
+	return &stats
+}
+
+// BufferbloatGrade grades the latency increase under load from A+ to F, following the thresholds
+// commonly used by bufferbloat tests. An empty string is returned when no loaded latency was measured
+func BufferbloatGrade(idlePing float64, loaded ...*LatencyStats) string {
+	var increase float64
+	var measured bool
+	for _, stats := range loaded {
+		if stats == nil {
+			continue
+		}
+		measured = true
+		increase = math.Max(increase, stats.Ping-idlePing)
+	}
+	if !measured {
+		return ""
+	}
+
+	switch {
+	case increase < 5:
+		return "A+"
+	case increase < 30:
+		return "A"
+	case increase < 60:
+		return "B"
+	case increase < 200:
+		return "C"
+	case increase < 400:
+		return "D"
+	default:
+		return "F"
+	}
+}
+
+// probeLatency sends a latency probe to the server every interval, using ICMP unless it is disabled
+// or gets no replies, and the ping URL otherwise. The probes stop when ctx is done or the returned function is called,
+// which returns the measured statistics
+func (s *Server) probeLatency(ctx context.Context, interval time.Duration) func() *LatencyStats {
+	ctx, cancel := context.WithCancel(ctx)
+
+	var lock sync.Mutex
+	var pings []float64
+	record := func(rtt time.Duration) {
+		lock.Lock()
+		pings = append(pings, float64(rtt.Milliseconds()))
+		lock.Unlock()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if !s.NoICMP && s.icmpProbe(ctx, interval, record) == nil {
+			return
+		}
+		s.httpProbe(ctx, interval, record)
+	}()
+
+	return func() *LatencyStats {
+		cancel()
+		<-done
+
+		lock.Lock()
+		defer lock.Unlock()
+		return newLatencyStats(pings)
+	}
+}
+
+// icmpProbe pings the server every interval until ctx is done. It gives up with an error when
+// no reply arrives within icmpReplyTimeout, or three intervals when they are longer
+func (s *Server) icmpProbe(ctx context.Context, interval time.Duration, record func(time.Duration)) error {
+	u, err := s.GetURL()
+	if err != nil {
+		return err
+	}
+
+	var replies int32
+	p := ping.New(u.Hostname())
+	p.Interval = interval
+	p.Source = s.SourceIP
+	p.SetNetwork(s.ipNetwork())
+	p.OnRecv = func(pkt *ping.Packet) {
+		atomic.AddInt32(&replies, 1)
+		record(pkt.Rtt)
+	}
+
+	replyTimeout := icmpReplyTimeout
+	if 3*interval > replyTimeout {
+		replyTimeout = 3 * interval
+	}
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		noReply := time.NewTimer(replyTimeout)
+		defer noReply.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				p.Stop()
+				return
+			case <-stopped:
+				return
+			case <-noReply.C:
+				if atomic.LoadInt32(&replies) == 0 {
+					p.Stop()
+					return
+				}
+			}
+		}
+	}()
+
+	if err := p.Run(); err != nil {
+		log.Debugf("Failed to send ICMP latency probes, will use HTTP: %s", err)
+		return err
+	}
+	if atomic.LoadInt32(&replies) == 0 && ctx.Err() == nil {
+		log.Debug("No reply to the ICMP latency probes, will use HTTP")
+		return errors.New("no reply to the ICMP latency probes")
+	}
+	return nil
+}
+
+// httpProbe requests the ping URL every interval until ctx is done
+func (s *Server) httpProbe(ctx context.Context, interval time.Duration, record func(time.Duration)) {
+	u, err := s.GetURL()
+	if err != nil {
+		return
+	}
+	u.Path = path.Join(u.Path, s.PingURL)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		log.Debugf("Failed when creating HTTP request: %s", err)
+		return
+	}
+	req.Header.Set("User-Agent", UserAgent)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		start := time.Now()
+		resp, err := s.GetHTTPClient().Do(req)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Debugf("Latency probe failed: %s", err)
+			}
+			continue
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		record(time.Since(start))
+	}
+}
+
+// getJitter calculates the jitter of the given round trip times, the same way the LibreSpeed web client does
+func getJitter(pings []float64) float64 {
+	var lastPing, jitter float64
+	for idx, p := range pings {
+		if idx != 0 {
+			instJitter := math.Abs(lastPing - p)
+			if idx > 1 {
+				if jitter > instJitter {
+					jitter = jitter*0.7 + instJitter*0.3
+				} else {
+					jitter = instJitter*0.2 + jitter*0.8
+				}
+			}
+		}
+		lastPing = p
+	}
+	return jitter
+}
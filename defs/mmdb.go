@@ -0,0 +1,440 @@
+package defs
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+)
+
+// mmdbMetadataMarker precedes the metadata at the end of a MaxMind DB file
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdbDataSeparator is the size of the zeroes between the search tree and the data section
+const mmdbDataSeparator = 16
+
+// mmdbMaxDepth limits the nesting of maps, arrays and pointers, so a broken file whose pointers
+// form a cycle can't exhaust the stack
+const mmdbMaxDepth = 512
+
+// mmdbMaxValues limits the values decoded for a single record or the metadata. Pointers can
+// make a small broken file expand to exponentially many values without nesting them too deep,
+// while the largest real records hold a few hundred
+const mmdbMaxValues = 1 << 16
+
+// MMDBProvider looks addresses up in local MaxMind DB files, such as the GeoLite2 and DB-IP
+// City, Country and ASN databases. It can't look up the client's own address
+type MMDBProvider struct {
+	readers []*mmdbReader
+}
+
+// OpenMMDB loads the given MaxMind DB files, the ones listed first take precedence when
+// several of them know the same field
+func OpenMMDB(paths ...string) (*MMDBProvider, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no MaxMind DB file given")
+	}
+	p := &MMDBProvider{}
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		r, err := newMMDBReader(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		p.readers = append(p.readers, r)
+	}
+	return p, nil
+}
+
+// Lookup implements GeoProvider
+func (p *MMDBProvider) Lookup(ctx context.Context, ip string) (*IPInfoResponse, error) {
+	if ip == "" {
+		return nil, ErrAddressRequired
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, fmt.Errorf("invalid IP address: %s", ip)
+	}
+
+	info := IPInfoResponse{IP: ip}
+	for _, r := range p.readers {
+		record, err := r.lookup(addr)
+		if err != nil {
+			return nil, err
+		}
+		if record != nil {
+			info = info.Merge(mmdbIPInfo(record))
+		}
+	}
+	return &info, nil
+}
+
+// mmdbIPInfo picks the fields of an IPInfoResponse from a GeoLite2 or DB-IP record
+func mmdbIPInfo(record map[string]interface{}) IPInfoResponse {
+	var info IPInfoResponse
+	info.City = mmdbString(record, "city", "names", "en")
+	if subdivisions, ok := record["subdivisions"].([]interface{}); ok && len(subdivisions) > 0 {
+		if subdivision, ok := subdivisions[0].(map[string]interface{}); ok {
+			info.Region = mmdbString(subdivision, "names", "en")
+		}
+	}
+	info.Country = mmdbString(record, "country", "iso_code")
+	info.Postal = mmdbString(record, "postal", "code")
+	info.Timezone = mmdbString(record, "location", "time_zone")
+
+	if location, ok := record["location"].(map[string]interface{}); ok {
+		lat, latOK := location["latitude"].(float64)
+		lon, lonOK := location["longitude"].(float64)
+		if latOK && lonOK {
+			info.Location = fmt.Sprintf("%.4f,%.4f", lat, lon)
+		}
+	}
+
+	// ASN databases, formatted the way ipinfo.io does
+	asOrg, _ := record["autonomous_system_organization"].(string)
+	if asn, ok := record["autonomous_system_number"].(uint64); ok {
+		info.Organization = strings.TrimSpace(fmt.Sprintf("AS%d %s", asn, asOrg))
+	} else {
+		info.Organization = asOrg
+	}
+	return info
+}
+
+// mmdbString follows the keys through nested maps and returns the string at the end, if any
+func mmdbString(record map[string]interface{}, keys ...string) string {
+	var value interface{} = record
+	for _, key := range keys {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = m[key]
+	}
+	str, _ := value.(string)
+	return str
+}
+
+// mmdbReader searches a MaxMind DB file held in memory, see
+// https://maxmind.github.io/MaxMind-DB/ for the format
+type mmdbReader struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// ipv4Start is the node IPv4 addresses start at in an IPv6 tree
+	ipv4Start uint
+}
+
+func newMMDBReader(b []byte) (*mmdbReader, error) {
+	i := bytes.LastIndex(b, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	meta := &mmdbDecoder{data: b[i+len(mmdbMetadataMarker):]}
+	value, _, err := meta.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %w", err)
+	}
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid metadata")
+	}
+
+	r := &mmdbReader{}
+	for key, field := range map[string]*uint{
+		"node_count":  &r.nodeCount,
+		"record_size": &r.recordSize,
+		"ip_version":  &r.ipVersion,
+	} {
+		n, ok := metadata[key].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("metadata has no %s", key)
+		}
+		*field = uint(n)
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", r.recordSize)
+	}
+
+	// the node count is checked before multiplying, so a huge one can't overflow the tree size
+	if r.nodeCount > uint(i)/(r.recordSize/4) {
+		return nil, errors.New("search tree is larger than the file")
+	}
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+mmdbDataSeparator > uint(i) {
+		return nil, errors.New("search tree is larger than the file")
+	}
+	r.tree = b[:treeSize]
+	r.data = b[treeSize+mmdbDataSeparator : i]
+
+	if r.ipVersion == 6 {
+		// IPv4 addresses are stored as ::a.b.c.d
+		node := uint(0)
+		for bit := 0; bit < 96 && node < r.nodeCount; bit++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of the node
+func (r *mmdbReader) record(node uint, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		off := node*6 + bit*3
+		b := r.tree[off : off+3]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.tree[node*7 : node*7+7]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		off := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(r.tree[off : off+4]))
+	}
+}
+
+// lookup returns the record of the network ip belongs to, nil when the database doesn't have it
+func (r *mmdbReader) lookup(ip net.IP) (map[string]interface{}, error) {
+	node := uint(0)
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+		node = r.ipv4Start
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < len(ip)*8 && node < r.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = r.record(node, bit)
+	}
+	if node == r.nodeCount {
+		return nil, nil
+	}
+	if node < r.nodeCount+mmdbDataSeparator {
+		return nil, errors.New("invalid search tree")
+	}
+
+	offset := node - r.nodeCount - mmdbDataSeparator
+	d := &mmdbDecoder{data: r.data}
+	value, _, err := d.decode(offset)
+	if err != nil {
+		return nil, err
+	}
+	record, _ := value.(map[string]interface{})
+	return record, nil
+}
+
+// mmdbDecoder decodes the values of a MaxMind DB data section
+type mmdbDecoder struct {
+	data []byte
+	// values counts the values decoded by the current decode call
+	values int
+}
+
+const (
+	mmdbTypePointer   = 1
+	mmdbTypeString    = 2
+	mmdbTypeDouble    = 3
+	mmdbTypeBytes     = 4
+	mmdbTypeUint16    = 5
+	mmdbTypeUint32    = 6
+	mmdbTypeMap       = 7
+	mmdbTypeInt32     = 8
+	mmdbTypeUint64    = 9
+	mmdbTypeUint128   = 10
+	mmdbTypeArray     = 11
+	mmdbTypeContainer = 12
+	mmdbTypeEndMarker = 13
+	mmdbTypeBool      = 14
+	mmdbTypeFloat     = 15
+)
+
+var errMMDBTruncated = errors.New("truncated MaxMind DB data")
+
+// take returns the n bytes at offset
+func (d *mmdbDecoder) take(offset, n uint) ([]byte, error) {
+	// offset may come from a broken pointer, so offset+n could overflow
+	if offset > uint(len(d.data)) || n > uint(len(d.data))-offset {
+		return nil, errMMDBTruncated
+	}
+	return d.data[offset : offset+n], nil
+}
+
+// decode decodes the value at offset and returns it with the offset of the next value
+func (d *mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	d.values = 0
+	return d.decodeValue(offset, 0)
+}
+
+// decodeValue decodes the value at offset, nested depth maps, arrays and pointers deep
+func (d *mmdbDecoder) decodeValue(offset uint, depth int) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errors.New("MaxMind DB data is nested too deep")
+	}
+	d.values++
+	if d.values > mmdbMaxValues {
+		return nil, 0, errors.New("MaxMind DB record has too many values")
+	}
+	ctrl, err := d.take(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset++
+	typ := uint(ctrl[0] >> 5)
+
+	if typ == mmdbTypePointer {
+		pointer, next, err := d.pointer(ctrl[0], offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		// the format doesn't allow a pointer to point to another pointer
+		target, err := d.take(pointer, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		if target[0]>>5 == mmdbTypePointer {
+			return nil, 0, errors.New("MaxMind DB pointer points to another pointer")
+		}
+		value, _, err := d.decodeValue(pointer, depth+1)
+		return value, next, err
+	}
+
+	if typ == 0 {
+		ext, err := d.take(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset++
+		typ = 7 + uint(ext[0])
+	}
+
+	size := uint(ctrl[0] & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.take(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + uint(beUint(b))
+		case 2:
+			size = 285 + uint(beUint(b))
+		case 3:
+			size = 65821 + uint(beUint(b))
+		}
+	}
+
+	// every entry takes at least a byte for the key and one for the value, so a size the rest of
+	// the data can't hold is rejected before anything is allocated for it
+	remaining := uint(len(d.data)) - offset
+	switch typ {
+	case mmdbTypeMap:
+		if size > remaining/2 {
+			return nil, 0, errMMDBTruncated
+		}
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decodeValue(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("MaxMind DB map key is not a string")
+			}
+			m[k], offset, err = d.decodeValue(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case mmdbTypeArray:
+		if size > remaining {
+			return nil, 0, errMMDBTruncated
+		}
+		a := make([]interface{}, size)
+		for i := range a {
+			a[i], offset, err = d.decodeValue(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, offset, nil
+	case mmdbTypeBool:
+		return size != 0, offset, nil
+	case mmdbTypeContainer, mmdbTypeEndMarker:
+		return nil, offset, nil
+	}
+
+	b, err := d.take(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+	switch typ {
+	case mmdbTypeString:
+		return string(b), offset, nil
+	case mmdbTypeDouble:
+		if size != 8 {
+			return nil, 0, errors.New("invalid MaxMind DB double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbTypeFloat:
+		if size != 4 {
+			return nil, 0, errors.New("invalid MaxMind DB float")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case mmdbTypeUint16, mmdbTypeUint32, mmdbTypeUint64:
+		return beUint(b), offset, nil
+	case mmdbTypeInt32:
+		return int64(int32(beUint(b))), offset, nil
+	case mmdbTypeBytes, mmdbTypeUint128:
+		return b, offset, nil
+	}
+	return nil, 0, fmt.Errorf("unknown MaxMind DB data type %d", typ)
+}
+
+// pointer decodes the pointer whose control byte is ctrl and whose payload starts at offset
+func (d *mmdbDecoder) pointer(ctrl byte, offset uint) (uint, uint, error) {
+	n := uint(ctrl>>3)&3 + 1
+	b, err := d.take(offset, n)
+	if err != nil {
+		return 0, 0, err
+	}
+	value := uint(ctrl & 7)
+	switch n {
+	case 1:
+		value = value<<8 | uint(beUint(b))
+	case 2:
+		value = (value<<16 | uint(beUint(b))) + 2048
+	case 3:
+		value = (value<<24 | uint(beUint(b))) + 526336
+	case 4:
+		value = uint(beUint(b))
+	}
+	return value, offset + n, nil
+}
+
+// beUint decodes a big endian unsigned integer of up to 8 bytes
+func beUint(b []byte) uint64 {
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n
+}
@@ -0,0 +1,282 @@
+package defs
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mmdbControl encodes the control bytes of a value of the given type and size
+func mmdbControl(typ int, size int) []byte {
+	var ext []byte
+	if typ > 7 {
+		ext = []byte{byte(typ - 7)}
+		typ = 0
+	}
+	var sizeBytes []byte
+	switch {
+	case size < 29:
+	case size < 285:
+		sizeBytes = []byte{byte(size - 29)}
+		size = 29
+	case size < 65821:
+		sizeBytes = []byte{byte((size - 285) >> 8), byte(size - 285)}
+		size = 30
+	default:
+		size -= 65821
+		sizeBytes = []byte{byte(size >> 16), byte(size >> 8), byte(size)}
+		size = 31
+	}
+	b := append([]byte{byte(typ<<5 | size)}, ext...)
+	return append(b, sizeBytes...)
+}
+
+func mmdbTestString(s string) []byte {
+	return append(mmdbControl(mmdbTypeString, len(s)), s...)
+}
+
+func mmdbTestUint(typ int, n uint64) []byte {
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append(mmdbControl(typ, len(b)), b...)
+}
+
+func mmdbTestDouble(f float64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, math.Float64bits(f))
+	return append(mmdbControl(mmdbTypeDouble, 8), b...)
+}
+
+// mmdbTestMap encodes a map from keys and values encoded in turn
+func mmdbTestMap(entries ...[]byte) []byte {
+	return append(mmdbControl(mmdbTypeMap, len(entries)/2), bytes.Join(entries, nil)...)
+}
+
+func mmdbTestArray(values ...[]byte) []byte {
+	return append(mmdbControl(mmdbTypeArray, len(values)), bytes.Join(values, nil)...)
+}
+
+// mmdbTestPointer encodes a pointer to an offset below 2048
+func mmdbTestPointer(offset int) []byte {
+	return []byte{byte(mmdbTypePointer<<5 | offset>>8), byte(offset)}
+}
+
+// mmdbTestFile builds an IPv4 database whose every address has the record at the start of data.
+// The single node of its tree points to the data, or nowhere when data is nil
+func mmdbTestFile(data []byte, metadata ...[]byte) []byte {
+	const nodeCount = 1
+	record := nodeCount
+	if data != nil {
+		record = nodeCount + mmdbDataSeparator
+	}
+	tree := []byte{byte(record >> 16), byte(record >> 8), byte(record), byte(record >> 16), byte(record >> 8), byte(record)}
+
+	if metadata == nil {
+		metadata = [][]byte{
+			mmdbTestString("node_count"), mmdbTestUint(mmdbTypeUint32, nodeCount),
+			mmdbTestString("record_size"), mmdbTestUint(mmdbTypeUint16, 24),
+			mmdbTestString("ip_version"), mmdbTestUint(mmdbTypeUint16, 4),
+		}
+	}
+	b := append(tree, make([]byte, mmdbDataSeparator)...)
+	b = append(b, data...)
+	b = append(b, mmdbMetadataMarker...)
+	return append(b, mmdbTestMap(metadata...)...)
+}
+
+// writeMMDB writes the database to a temporary file and returns its path
+func writeMMDB(t *testing.T, name string, b []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMMDBLookup(t *testing.T) {
+	names := mmdbTestMap(mmdbTestString("en"), mmdbTestString("Prague"))
+	city := mmdbTestFile(mmdbTestMap(
+		mmdbTestString("city"), mmdbTestMap(mmdbTestString("names"), names),
+		mmdbTestString("country"), mmdbTestMap(mmdbTestString("iso_code"), mmdbTestString("CZ")),
+		mmdbTestString("location"), mmdbTestMap(
+			mmdbTestString("latitude"), mmdbTestDouble(50.0880),
+			mmdbTestString("longitude"), mmdbTestDouble(14.4208),
+			mmdbTestString("time_zone"), mmdbTestString("Europe/Prague"),
+		),
+		mmdbTestString("postal"), mmdbTestMap(mmdbTestString("code"), mmdbTestString("110 00")),
+		mmdbTestString("subdivisions"), mmdbTestArray(
+			mmdbTestMap(mmdbTestString("names"), mmdbTestMap(mmdbTestString("en"), mmdbTestString("Praha"))),
+		),
+	))
+	// the ASN record starts with a pointer to the organisation's name stored after it
+	asnRecord := mmdbTestMap(
+		mmdbTestString("autonomous_system_number"), mmdbTestUint(mmdbTypeUint32, 64500),
+		mmdbTestString("autonomous_system_organization"), mmdbTestPointer(0),
+	)
+	asnRecord = mmdbTestMap(
+		mmdbTestString("autonomous_system_number"), mmdbTestUint(mmdbTypeUint32, 64500),
+		mmdbTestString("autonomous_system_organization"), mmdbTestPointer(len(asnRecord)),
+	)
+	asn := mmdbTestFile(append(asnRecord, mmdbTestString("Example Networks")...))
+
+	p, err := OpenMMDB(writeMMDB(t, "city.mmdb", city), writeMMDB(t, "asn.mmdb", asn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := p.Lookup(context.Background(), "203.0.113.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := IPInfoResponse{
+		IP:           "203.0.113.7",
+		City:         "Prague",
+		Region:       "Praha",
+		Country:      "CZ",
+		Location:     "50.0880,14.4208",
+		Organization: "AS64500 Example Networks",
+		Postal:       "110 00",
+		Timezone:     "Europe/Prague",
+	}
+	if *info != want {
+		t.Errorf("got %+v, want %+v", *info, want)
+	}
+
+	if _, err := p.Lookup(context.Background(), ""); err != ErrAddressRequired {
+		t.Errorf("looking up your own address returned %v, want %v", err, ErrAddressRequired)
+	}
+	if _, err := p.Lookup(context.Background(), "not an address"); err == nil {
+		t.Error("looking up an invalid address returned no error")
+	}
+	// an IPv4 database doesn't know IPv6 addresses
+	if info, err := p.Lookup(context.Background(), "2001:db8::1"); err != nil || info.Country != "" {
+		t.Errorf("looking up an IPv6 address returned %+v, %v", info, err)
+	}
+}
+
+func TestMMDBNotFound(t *testing.T) {
+	r, err := newMMDBReader(mmdbTestFile(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := r.lookup(net.ParseIP("203.0.113.7"))
+	if err != nil || record != nil {
+		t.Errorf("got %v, %v, want no record", record, err)
+	}
+}
+
+func TestMMDBBrokenFiles(t *testing.T) {
+	// chain holds 64 arrays, each with two pointers to the one before, which expand to 2^64 values
+	// while nesting only 128 deep. The record comes first, it is a pointer to the top of the chain
+	const chainStart = 2
+	chain := mmdbTestString("leaf")
+	last := chainStart
+	for i := 0; i < 64; i++ {
+		next := chainStart + len(chain)
+		chain = append(chain, mmdbTestArray(mmdbTestPointer(last), mmdbTestPointer(last))...)
+		last = next
+	}
+	chainRecord := append(mmdbTestPointer(last), chain...)
+
+	tests := []struct {
+		name    string
+		file    []byte
+		lookup  bool
+		wantErr string
+	}{
+		{"not a database", []byte("hello"), false, "not a MaxMind DB file"},
+		{
+			"truncated metadata",
+			append(append([]byte{}, mmdbMetadataMarker...), mmdbControl(mmdbTypeMap, 3)...),
+			false,
+			"truncated",
+		},
+		{
+			"huge node count",
+			mmdbTestFile([]byte{}, mmdbTestString("node_count"), mmdbTestUint(mmdbTypeUint64, math.MaxUint64),
+				mmdbTestString("record_size"), mmdbTestUint(mmdbTypeUint16, 24),
+				mmdbTestString("ip_version"), mmdbTestUint(mmdbTypeUint16, 4)),
+			false,
+			"search tree is larger than the file",
+		},
+		{
+			"unsupported record size",
+			mmdbTestFile([]byte{}, mmdbTestString("node_count"), mmdbTestUint(mmdbTypeUint32, 1),
+				mmdbTestString("record_size"), mmdbTestUint(mmdbTypeUint16, 20),
+				mmdbTestString("ip_version"), mmdbTestUint(mmdbTypeUint16, 4)),
+			false,
+			"unsupported record size",
+		},
+		{"pointer cycle", mmdbTestFile(mmdbTestMap(mmdbTestString("a"), mmdbTestPointer(0))), true, "nested too deep"},
+		{"pointer to a pointer", mmdbTestFile(append(mmdbTestPointer(2), mmdbTestPointer(0)...)), true, "another pointer"},
+		{"pointer out of the data", mmdbTestFile(mmdbTestMap(mmdbTestString("a"), mmdbTestPointer(2000))), true, "truncated"},
+		{"exponential expansion", mmdbTestFile(chainRecord), true, "too many values"},
+		{"oversized map", mmdbTestFile(mmdbControl(mmdbTypeMap, 65821+0xffffff)), true, "truncated"},
+		{"oversized array", mmdbTestFile(mmdbControl(mmdbTypeArray, 65821+0xffffff)), true, "truncated"},
+		{"oversized string", mmdbTestFile(mmdbControl(mmdbTypeString, 300)), true, "truncated"},
+		{"non-string key", mmdbTestFile(mmdbTestMap(mmdbTestUint(mmdbTypeUint16, 1), mmdbTestString("a"))), true, "not a string"},
+		{"unknown type", mmdbTestFile(mmdbControl(20, 0)), true, "unknown MaxMind DB data type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done := make(chan error, 1)
+			go func() {
+				r, err := newMMDBReader(tt.file)
+				if err == nil && tt.lookup {
+					_, err = r.lookup(net.ParseIP("203.0.113.7"))
+				}
+				done <- err
+			}()
+
+			select {
+			case err := <-done:
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("decoding didn't finish")
+			}
+		})
+	}
+}
+
+func TestMMDBTreePointingIntoSeparator(t *testing.T) {
+	b := mmdbTestFile(mmdbTestString("record"))
+	// the node's records point to the zeroes between the tree and the data
+	copy(b, []byte{0, 0, 2, 0, 0, 2})
+	r, err := newMMDBReader(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.lookup(net.ParseIP("203.0.113.7")); err == nil {
+		t.Error("a record pointing into the separator returned no error")
+	}
+}
+
+func TestMMDBRecord(t *testing.T) {
+	tests := []struct {
+		recordSize  uint
+		node        []byte
+		left, right uint
+	}{
+		{24, []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc}, 0x123456, 0x789abc},
+		{28, []byte{0x23, 0x45, 0x67, 0x18, 0x9a, 0xbc, 0xde}, 0x1234567, 0x89abcde},
+		{32, []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}, 0x01234567, 0x89abcdef},
+	}
+	for _, tt := range tests {
+		// the node is the second one of the tree
+		r := &mmdbReader{tree: append(make([]byte, len(tt.node)), tt.node...), recordSize: tt.recordSize}
+		if left, right := r.record(1, 0), r.record(1, 1); left != tt.left || right != tt.right {
+			t.Errorf("%d bit records are %#x and %#x, want %#x and %#x", tt.recordSize, left, right, tt.left, tt.right)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package defs
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"sync"
+)
+
+var (
+	hashSaltOnce sync.Once
+	// hashSalt is chosen at random once per run, nil when it couldn't be generated
+	hashSalt []byte
+)
+
+// MaskIP zeroes the host part of an IP address, keeping the /24 network of an IPv4 address
+// and the /48 network of an IPv6 address. Anything that isn't an IP address is hashed
+func MaskIP(ip string) string {
+	if ip == "" {
+		return ""
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return HashString(ip)
+	}
+	if ipv4 := addr.To4(); ipv4 != nil {
+		return ipv4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return addr.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// HashString returns a short salted SHA-256 digest of s. The salt is random and chosen once per run,
+// so the same s gives the same digest within a run, but a digest can't be matched against hashed
+// guesses afterwards. Nothing is returned when no salt could be generated
+func HashString(s string) string {
+	if s == "" {
+		return ""
+	}
+	hashSaltOnce.Do(func() {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err == nil {
+			hashSalt = salt
+		}
+	})
+	if hashSalt == nil {
+		return ""
+	}
+
+	h := sha256.New()
+	h.Write(hashSalt)
+	h.Write([]byte(s))
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// Redact returns the client with its addresses masked, its host name hashed and its location dropped
+func (c Client) Redact() Client {
+	return Client{
+		IPInfoResponse: IPInfoResponse{
+			IP:           MaskIP(c.IP),
+			Hostname:     HashString(c.Hostname),
+			Organization: c.Organization,
+		},
+		SourceIP:  MaskIP(c.SourceIP),
+		Interface: c.Interface,
+	}
+}
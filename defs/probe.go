@@ -0,0 +1,143 @@
+package defs
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/go-ping/ping"
+	log "github.com/sirupsen/logrus"
+)
+
+// probeInterval is the interval between the ICMP probes sent by Probe
+const probeInterval = 200 * time.Millisecond
+
+// ProbeResult represents the round trip times measured by Probe
+type ProbeResult struct {
+	// Pings holds the round trip times of the answered probes in milliseconds
+	Pings []float64
+	// Sent is the number of probes sent
+	Sent int
+}
+
+// Median returns the median round trip time in milliseconds, zero when no probe was answered
+func (r ProbeResult) Median() float64 {
+	if len(r.Pings) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), r.Pings...)
+	sort.Float64s(sorted)
+	return percentile(sorted, 50)
+}
+
+// Jitter returns the jitter of the round trip times in milliseconds
+func (r ProbeResult) Jitter() float64 {
+	return getJitter(r.Pings)
+}
+
+// Loss returns the share of the probes that weren't answered, from 0 to 1
+func (r ProbeResult) Loss() float64 {
+	if r.Sent == 0 {
+		return 1
+	}
+	return 1 - float64(len(r.Pings))/float64(r.Sent)
+}
+
+// Probe sends count latency probes to the server, using ICMP unless it is disabled or doesn't get any
+// answer and the ping URL otherwise. Unlike PingAndJitter, a failed probe counts as lost
+func (s *Server) Probe(ctx context.Context, count int) (*ProbeResult, error) {
+	t := time.Now()
+	defer func() {
+		s.TLog.Logf("Probing took %s", time.Now().Sub(t).String())
+	}()
+
+	if !s.NoICMP {
+		result, err := s.icmpProbes(ctx, count)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if err == nil && len(result.Pings) > 0 {
+			return result, nil
+		}
+		log.Debugf("No ICMP probe answered by server %s, will use HTTP", s.Name)
+	}
+	return s.httpProbes(ctx, count)
+}
+
+// icmpProbes sends count ICMP echos to the server
+func (s *Server) icmpProbes(ctx context.Context, count int) (*ProbeResult, error) {
+	u, err := s.GetURL()
+	if err != nil {
+		return nil, err
+	}
+
+	p := ping.New(u.Hostname())
+	p.Count = count
+	p.Interval = probeInterval
+	p.Timeout = time.Duration(count)*probeInterval + time.Second
+	p.Source = s.SourceIP
+	p.SetNetwork(s.ipNetwork())
+
+	pingDone := make(chan struct{})
+	defer close(pingDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.Stop()
+		case <-pingDone:
+		}
+	}()
+
+	if err := p.Run(); err != nil {
+		log.Debugf("Failed to ping target host: %s", err)
+		return nil, err
+	}
+
+	stats := p.Statistics()
+	result := ProbeResult{Sent: count}
+	for _, rtt := range stats.Rtts {
+		result.Pings = append(result.Pings, float64(rtt.Microseconds())/1000)
+	}
+	return &result, nil
+}
+
+// httpProbes requests the ping URL count times, after a first request setting up the connection
+func (s *Server) httpProbes(ctx context.Context, count int) (*ProbeResult, error) {
+	u, err := s.GetURL()
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Join(u.Path, s.PingURL)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		log.Debugf("Failed when creating HTTP request: %s", err)
+		return nil, err
+	}
+	req.Header.Set("User-Agent", UserAgent)
+
+	result := ProbeResult{Sent: count}
+	for i := 0; i <= count; i++ {
+		start := time.Now()
+		resp, err := s.GetHTTPClient().Do(req)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if err != nil {
+			log.Debugf("Failed when making HTTP request: %s", err)
+			continue
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		// the first request includes the handshake
+		if i > 0 {
+			result.Pings = append(result.Pings, float64(time.Since(start).Microseconds())/1000)
+		}
+	}
+	return &result, nil
+}
@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math"
 	"net"
 	"net/http"
 	"net/url"
@@ -17,7 +16,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/briandowns/spinner"
 	"github.com/go-ping/ping"
 	log "github.com/sirupsen/logrus"
 	"github.com/umahmood/haversine"
@@ -35,8 +33,23 @@ type Server struct {
 	SponsorName string `json:"sponsorName"`
 	SponsorURL  string `json:"sponsorURL"`
 
-	NoICMP bool         `json:"-"`
-	TLog   TelemetryLog `json:"-"`
+	NoICMP bool          `json:"-"`
+	TLog   *TelemetryLog `json:"-"`
+	// Events receives ping and throughput samples while the server is being tested
+	Events EventHandler `json:"-"`
+	// EventInterval is the interval between throughput samples, DefaultEventInterval is used when zero
+	EventInterval time.Duration `json:"-"`
+	// HTTPClient is used for every request made to the server, http.DefaultClient is used when nil
+	HTTPClient *http.Client `json:"-"`
+	// SourceIP is the local address ICMP pings are sent from
+	SourceIP string `json:"-"`
+	// IPVersion restricts ICMP pings and the server address lookup to IPv4 (4) or IPv6 (6), zero allows both
+	IPVersion int `json:"-"`
+	// Location is the server's location as "latitude,longitude", it may come with the server list
+	// and is otherwise filled in by Locate
+	Location string `json:"loc,omitempty"`
+	// Geo looks up the location of the server and of the client, ipinfo.io is used when nil
+	Geo GeoProvider `json:"-"`
 }
 
 func (s Server) String() string {
@@ -51,7 +64,7 @@ func (s Server) String() string {
 }
 
 // IsUp checks the speed test backend is up by accessing the ping URL
-func (s *Server) IsUp() bool {
+func (s *Server) IsUp(ctx context.Context) bool {
 	t := time.Now()
 	defer func() {
 		s.TLog.Logf("Check backend is up took %s", time.Now().Sub(t).String())
@@ -60,14 +73,14 @@ func (s *Server) IsUp() bool {
 	u, _ := s.GetURL()
 	u.Path, _ = url.JoinPath(u.Path, s.PingURL)
 
-	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
 	if err != nil {
 		log.Debugf("Failed when creating HTTP request: %s", err)
 		return false
 	}
 	req.Header.Set("User-Agent", UserAgent)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := s.GetHTTPClient().Do(req)
 	if err != nil {
 		log.Debugf("Error checking for server status: %s", err)
 		return false
@@ -82,7 +95,7 @@ func (s *Server) IsUp() bool {
 }
 
 // ICMPPingAndJitter pings the server via ICMP echos and calculate the average ping and jitter
-func (s *Server) ICMPPingAndJitter(count int) (float64, float64, error) {
+func (s *Server) ICMPPingAndJitter(ctx context.Context, count int) (float64, float64, error) {
 	t := time.Now()
 	defer func() {
 		s.TLog.Logf("ICMP ping took %s", time.Now().Sub(t).String())
@@ -90,7 +103,7 @@ func (s *Server) ICMPPingAndJitter(count int) (float64, float64, error) {
 
 	if s.NoICMP {
 		log.Debugf("Skipping ICMP for server %s, will use HTTP ping", s.Name)
-		return s.PingAndJitter(count + 2)
+		return s.PingAndJitter(ctx, count+2)
 	}
 
 	u, err := s.GetURL()
@@ -102,31 +115,43 @@ func (s *Server) ICMPPingAndJitter(count int) (float64, float64, error) {
 	p := ping.New(u.Hostname())
 	p.Count = count
 	p.Timeout = time.Duration(count) * time.Second
+	p.Source = s.SourceIP
+	p.SetNetwork(s.ipNetwork())
 	if log.GetLevel() == log.DebugLevel {
 		p.Debug = true
 	}
-	if err := p.Run(); err != nil {
+	p.OnRecv = func(pkt *ping.Packet) {
+		s.Emit(Event{Type: EventPingSample, Phase: PhasePing, Ping: float64(pkt.Rtt.Milliseconds())})
+	}
+
+	// the pinger has no notion of a context, stop it by hand when ours is done
+	pingDone := make(chan struct{})
+	defer close(pingDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.Stop()
+		case <-pingDone:
+		}
+	}()
+
+	err = p.Run()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return 0, 0, ctxErr
+	}
+	if err != nil {
 		log.Debugf("Failed to ping target host: %s", err)
 		log.Debug("Will try TCP ping")
-		return s.PingAndJitter(count + 2)
+		return s.PingAndJitter(ctx, count+2)
 	}
 
 	stats := p.Statistics()
 
-	var lastPing, jitter float64
-	for idx, rtt := range stats.Rtts {
-		if idx != 0 {
-			instJitter := math.Abs(lastPing - float64(rtt.Milliseconds()))
-			if idx > 1 {
-				if jitter > instJitter {
-					jitter = jitter*0.7 + instJitter*0.3
-				} else {
-					jitter = instJitter*0.2 + jitter*0.8
-				}
-			}
-		}
-		lastPing = float64(rtt.Milliseconds())
+	var pings []float64
+	for _, rtt := range stats.Rtts {
+		pings = append(pings, float64(rtt.Milliseconds()))
 	}
+	jitter := getJitter(pings)
 
 	if len(stats.Rtts) == 0 {
 		s.NoICMP = true
@@ -135,14 +160,14 @@ func (s *Server) ICMPPingAndJitter(count int) (float64, float64, error) {
 			s.Name,
 			u.Hostname(),
 		)
-		return s.PingAndJitter(count + 2)
+		return s.PingAndJitter(ctx, count+2)
 	}
 
 	return float64(stats.AvgRtt.Milliseconds()), jitter, nil
 }
 
 // PingAndJitter pings the server via accessing ping URL and calculate the average ping and jitter
-func (s *Server) PingAndJitter(count int) (float64, float64, error) {
+func (s *Server) PingAndJitter(ctx context.Context, count int) (float64, float64, error) {
 	t := time.Now()
 	defer func() {
 		s.TLog.Logf("TCP ping took %s", time.Now().Sub(t).String())
@@ -157,7 +182,7 @@ func (s *Server) PingAndJitter(count int) (float64, float64, error) {
 
 	var pings []float64
 
-	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
 	if err != nil {
 		log.Debugf("Failed when creating HTTP request: %s", err)
 		return 0, 0, err
@@ -166,7 +191,7 @@ func (s *Server) PingAndJitter(count int) (float64, float64, error) {
 
 	for i := 0; i < count; i++ {
 		start := time.Now()
-		resp, err := http.DefaultClient.Do(req)
+		resp, err := s.GetHTTPClient().Do(req)
 		if err != nil {
 			log.Debugf("Failed when making HTTP request: %s", err)
 			return 0, 0, err
@@ -176,6 +201,7 @@ func (s *Server) PingAndJitter(count int) (float64, float64, error) {
 		end := time.Now()
 
 		pings = append(pings, float64(end.Sub(start).Milliseconds()))
+		s.Emit(Event{Type: EventPingSample, Phase: PhasePing, Ping: pings[len(pings)-1]})
 	}
 
 	// discard first result due to handshake overhead
@@ -183,172 +209,68 @@ func (s *Server) PingAndJitter(count int) (float64, float64, error) {
 		pings = pings[1:]
 	}
 
-	var lastPing, jitter float64
-	for idx, p := range pings {
-		if idx != 0 {
-			instJitter := math.Abs(lastPing - p)
-			if idx > 1 {
-				if jitter > instJitter {
-					jitter = jitter*0.7 + instJitter*0.3
-				} else {
-					jitter = instJitter*0.2 + jitter*0.8
-				}
-			}
-		}
-		lastPing = p
-	}
-
-	return getAvg(pings), jitter, nil
+	return getAvg(pings), getJitter(pings), nil
 }
 
-// Download performs the ManualDownload test, but omits the variables used for direct output
+// ManualDownload performs the actual download test, emitting throughput samples to s.Events.
 // Returns speeds in Mbps.
-func (s *Server) Download(
-	requests int,
-	chunks int,
-	duration time.Duration,
-) (float64, int, error) {
-	return s.ManualDownload(false, false, false, requests, chunks, duration)
-}
-
-// Upload performs the ManualUpload test, but omits the variables used for direct output
-func (s *Server) Upload(
-	noPrealloc bool,
-	requests int,
-	uploadSize int,
-	duration time.Duration,
-) (float64, int, error) {
-	return s.ManualUpload(
-		noPrealloc,
-		false,
-		false,
-		false,
-		requests,
-		uploadSize,
-		duration,
-	)
-}
-
-// ManualDownload performs the actual download test with optional real-time output.
-// Returns speeds in Mbps.
-func (s *Server) ManualDownload(
-	verbose bool,
-	useBytes bool,
-	useBinaryBase bool,
-	requests int,
-	chunks int,
-	duration time.Duration,
-) (float64, int, error) {
+func (s *Server) ManualDownload(ctx context.Context, opts TransferOptions) (*TransferResult, error) {
 	t := time.Now()
 	defer func() {
 		s.TLog.Logf("Download took %s", time.Now().Sub(t).String())
 	}()
 
 	counter := NewCounter()
-	counter.SetBinaryBase(useBinaryBase)
-
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
 
 	u, err := s.GetURL()
 	if err != nil {
 		log.Debugf("Failed to get server URL: %s", err)
-		return 0, 0, err
+		return nil, err
 	}
 
 	u.Path = path.Join(u.Path, s.DownloadURL)
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
 	if err != nil {
 		log.Debugf("Failed when creating HTTP request: %s", err)
-		return 0, 0, err
+		return nil, err
 	}
 	q := req.URL.Query()
-	q.Set("ckSize", strconv.Itoa(chunks))
+	q.Set("ckSize", strconv.Itoa(opts.Chunks))
 	req.URL.RawQuery = q.Encode()
 	req.Header.Set("User-Agent", UserAgent)
 	req.Header.Set("Accept-Encoding", "identity")
 
-	downloadDone := make(chan struct{}, requests)
-
-	doDownload := func() {
-		resp, err := http.DefaultClient.Do(req)
+	doDownload := func(ctx context.Context) bool {
+		resp, err := s.GetHTTPClient().Do(req.WithContext(ctx))
 		if err != nil {
 			log.Debugf("Failed when making HTTP request: %s", err)
-		} else {
-			defer resp.Body.Close()
-
-			if _, err = io.Copy(ioutil.Discard, io.TeeReader(resp.Body, counter)); err != nil {
-				if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
-					log.Debugf("Failed when reading HTTP response: %s", err)
-				}
-			}
-
-			downloadDone <- struct{}{}
-		}
-	}
-
-	counter.Start()
-	if verbose {
-		pb := spinner.New(spinner.CharSets[11], 100*time.Millisecond)
-		pb.Prefix = "Downloading...  "
-		pb.PostUpdate = func(s *spinner.Spinner) {
-			s.Suffix = fmt.Sprintf("  %s", counter.AvgHumanize(useBytes))
+			return false
 		}
+		defer resp.Body.Close()
 
-		pb.Start()
-		defer func() {
-			if useBytes {
-				pb.FinalMSG = fmt.Sprintf(
-					"Download rate:\t%s\n",
-					counter.AvgHumanize(useBytes),
-				)
-			} else {
-				pb.FinalMSG = fmt.Sprintf("Download rate:\t%s\n", counter.AvgHumanize(useBytes))
+		if _, err = io.Copy(ioutil.Discard, io.TeeReader(resp.Body, counter)); err != nil {
+			if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+				log.Debugf("Failed when reading HTTP response: %s", err)
 			}
-			pb.Stop()
-		}()
-	}
-
-	for i := 0; i < requests; i++ {
-		go doDownload()
-		time.Sleep(200 * time.Millisecond)
-	}
-	timeout := time.After(duration)
-Loop:
-	for {
-		select {
-		case <-timeout:
-			ctx.Done()
-			break Loop
-		case <-downloadDone:
-			go doDownload()
 		}
+		return true
 	}
 
-	return counter.AvgMbps(), counter.Total(), nil
+	return s.runTransfer(ctx, PhaseDownload, counter, opts, doDownload)
 }
 
-// ManualUpload performs the actual upload test with optional real-time output.
+// ManualUpload performs the actual upload test, emitting throughput samples to s.Events.
 // Returns speeds in Mbps.
-func (s *Server) ManualUpload(
-	noPrealloc bool,
-	verbose bool,
-	useBytes bool,
-	useBinaryBase bool,
-	requests int,
-	uploadSize int,
-	duration time.Duration,
-) (float64, int, error) {
+func (s *Server) ManualUpload(ctx context.Context, opts TransferOptions) (*TransferResult, error) {
 	t := time.Now()
 	defer func() {
 		s.TLog.Logf("Upload took %s", time.Now().Sub(t).String())
 	}()
 
 	counter := NewCounter()
-	counter.SetBinaryBase(useBinaryBase)
-	counter.SetUploadSize(uploadSize)
+	counter.SetUploadSize(opts.UploadSize)
 
-	if noPrealloc {
+	if opts.NoPrealloc {
 		log.Info("Pre-allocation is disabled, performance might be lower!")
 		counter.reader = &SeekWrapper{rand.Reader}
 	} else {
@@ -358,154 +280,307 @@ func (s *Server) ManualUpload(
 	u, err := s.GetURL()
 	if err != nil {
 		log.Debugf("Failed to get server URL: %s", err)
-		return 0, 0, err
+		return nil, err
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
 	u.Path = path.Join(u.Path, s.UploadURL)
-	req, err := http.NewRequestWithContext(
-		ctx,
-		http.MethodPost,
-		u.String(),
-		counter,
-	)
+	req, err := http.NewRequest(http.MethodPost, u.String(), counter)
 	if err != nil {
 		log.Debugf("Failed when creating HTTP request: %s", err)
-		return 0, 0, err
+		return nil, err
 	}
 	req.Header.Set("User-Agent", UserAgent)
 	req.Header.Set("Accept-Encoding", "identity")
 
-	uploadDone := make(chan struct{}, requests)
-
-	doUpload := func() {
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil && !errors.Is(err, context.Canceled) &&
-			!errors.Is(err, context.DeadlineExceeded) {
-			log.Debugf("Failed when making HTTP request: %s", err)
-		} else if err == nil {
-			defer resp.Body.Close()
-			if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
-				log.Debugf("Failed when reading HTTP response: %s", err)
+	doUpload := func(ctx context.Context) bool {
+		resp, err := s.GetHTTPClient().Do(req.WithContext(ctx))
+		if err != nil {
+			if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+				log.Debugf("Failed when making HTTP request: %s", err)
 			}
-
-			uploadDone <- struct{}{}
+			return false
+		}
+		defer resp.Body.Close()
+		if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+			log.Debugf("Failed when reading HTTP response: %s", err)
 		}
+		return true
 	}
 
-	counter.Start()
-	if verbose {
-		pb := spinner.New(spinner.CharSets[11], 100*time.Millisecond)
-		pb.Prefix = "Uploading...  "
-		pb.PostUpdate = func(s *spinner.Spinner) {
-			s.Suffix = fmt.Sprintf("  %s", counter.AvgHumanize(useBytes))
-		}
+	return s.runTransfer(ctx, PhaseUpload, counter, opts, doUpload)
+}
 
-		pb.Start()
-		defer func() {
-			if useBytes {
-				pb.FinalMSG = fmt.Sprintf(
-					"Upload rate:\t%s\n",
-					counter.AvgHumanize(useBytes),
-				)
-			} else {
-				pb.FinalMSG = fmt.Sprintf("Upload rate:\t%s\n", counter.AvgHumanize(useBytes))
-			}
-			pb.Stop()
-		}()
+// GetIPInfo accesses the backend's getIP.php endpoint and get current client's IP information
+func (s *Server) GetIPInfo(ctx context.Context, distanceUnit string) (*GetIPResult, error) {
+	values := url.Values{}
+	values.Set("isp", "true")
+	values.Set("distance", distanceUnit)
+	return s.getIP(ctx, values)
+}
+
+// GetIP accesses the backend's getIP.php endpoint for current client's IP address only,
+// without the backend looking up the ISP
+func (s *Server) GetIP(ctx context.Context) (*GetIPResult, error) {
+	return s.getIP(ctx, nil)
+}
+
+func (s *Server) getIP(ctx context.Context, query url.Values) (*GetIPResult, error) {
+	if s.GetIPURL == "" {
+		return nil, errors.New("server has no getIP endpoint")
+	}
+	u, err := s.GetURL()
+	if err != nil {
+		log.Debugf("Failed to get server URL: %s", err)
+		return nil, err
 	}
 
-	for i := 0; i < requests; i++ {
-		go doUpload()
-		time.Sleep(200 * time.Millisecond)
+	u.Path = path.Join(u.Path, s.GetIPURL)
+	values := u.Query()
+	for key := range query {
+		values.Set(key, query.Get(key))
 	}
-	timeout := time.After(duration)
-Loop:
-	for {
-		select {
-		case <-timeout:
-			ctx.Done()
-			break Loop
-		case <-uploadDone:
-			go doUpload()
+	u.RawQuery = values.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		log.Debugf("Failed when creating HTTP request: %s", err)
+		return nil, err
+	}
+	req.Header.Set("User-Agent", UserAgent)
+
+	resp, err := s.GetHTTPClient().Do(req)
+	if err != nil {
+		log.Debugf("Failed when making HTTP request: %s", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("getIP returned %s", resp.Status)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Debugf("Failed when reading HTTP response: %s", err)
+		return nil, err
+	}
+	return parseGetIPResult(b), nil
+}
+
+// parseGetIPResult parses the getIP.php response. Backends that failed to look the ISP up send
+// rawIspInfo as an empty string and the older ones send just the address as plain text
+func parseGetIPResult(b []byte) *GetIPResult {
+	var ipInfo GetIPResult
+	var payload struct {
+		ProcessedString string          `json:"processedString"`
+		RawISPInfo      json.RawMessage `json:"rawIspInfo"`
+	}
+	if err := json.Unmarshal(b, &payload); err != nil {
+		log.Debugf("Failed when parsing get IP result: %s", err)
+		log.Debugf("Received payload: %s", b)
+		ipInfo.ProcessedString = strings.TrimSpace(string(b))
+	} else {
+		ipInfo.ProcessedString = payload.ProcessedString
+		if len(payload.RawISPInfo) > 0 {
+			if err := json.Unmarshal(payload.RawISPInfo, &ipInfo.RawISPInfo); err != nil {
+				log.Debugf("No ISP info in the get IP result: %s", payload.RawISPInfo)
+			}
 		}
 	}
 
-	return counter.AvgMbps(), counter.Total(), nil
+	// the processed string starts with the client's address
+	if ipInfo.RawISPInfo.IP == "" {
+		if fields := strings.Fields(ipInfo.ProcessedString); len(fields) > 0 && net.ParseIP(fields[0]) != nil {
+			ipInfo.RawISPInfo.IP = fields[0]
+		}
+	}
+	return &ipInfo
 }
 
-// GetIPInfo accesses the backend's getIP.php endpoint and get current client's IP information
-func (s *Server) WorkaroundGetIPInfo(distanceUnit string) (*GetIPResult, error) {
-	resp, err := http.Get("https://ipinfo.io/json")
+// WorkaroundGetIPInfo gets current client's IP information from ipinfo.io instead of the backend,
+// for backends whose getIP.php endpoint doesn't work
+func (s *Server) WorkaroundGetIPInfo(ctx context.Context, distanceUnit string) (*GetIPResult, error) {
+	provider, ok := s.Geo.(*IPInfoProvider)
+	if !ok {
+		provider = &IPInfoProvider{Client: s.GetHTTPClient()}
+	}
+	return s.lookupIPInfo(ctx, provider, IPInfoResponse{}, distanceUnit)
+}
+
+// LookupIPInfo gets current client's IP information from s.Geo, looking up the address in client.
+// The fields the provider doesn't know are kept from client
+func (s *Server) LookupIPInfo(ctx context.Context, client IPInfoResponse, distanceUnit string) (*GetIPResult, error) {
+	return s.lookupIPInfo(ctx, s.geoProvider(), client, distanceUnit)
+}
+
+func (s *Server) lookupIPInfo(
+	ctx context.Context,
+	provider GeoProvider,
+	client IPInfoResponse,
+	distanceUnit string,
+) (*GetIPResult, error) {
+	info, err := provider.Lookup(ctx, client.IP)
 	if err != nil {
-		log.Debugf("Failed getting IP Info: %s", err)
 		return nil, err
 	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	clientInfo := info.Merge(client)
 
-	var clientInfo IPInfoResponse
-	if len(body) > 0 {
-		if err := json.Unmarshal(body, &clientInfo); err != nil {
-			log.Debugf("Failed when parsing get IP result: %s", err)
-			log.Debugf("Received payload: %s", body)
+	serverLocation, err := s.Locate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var processedString string
+	if clientInfo.IP != "" {
+		processedString = clientInfo.IP
+	}
+	if clientInfo.Organization != "" {
+		processedString = processedString + " - " + clientInfo.Organization
+	}
+	if clientInfo.Country != "" {
+		processedString = processedString + ", " + clientInfo.Country
+	}
+	if clientInfo.Location != "" && serverLocation != "" {
+		distance := calculateDistance(clientInfo.Location, serverLocation, distanceUnit)
+		if distance != "" {
+			processedString = processedString + " (" + distance + ")"
 		}
 	}
 
-	var serverUrl *url.URL
-	if serverUrl, err = s.GetURL(); err != nil {
-		return nil, err
+	return &GetIPResult{ProcessedString: processedString, RawISPInfo: clientInfo}, nil
+}
+
+// FetchIPInfo looks up the given IP address on ipinfo.io, an empty ip looks up the client's own address
+func FetchIPInfo(ctx context.Context, client *http.Client, ip string) (*IPInfoResponse, error) {
+	return (&IPInfoProvider{Client: client}).Lookup(ctx, ip)
+}
+
+// ResolveIP returns the address the server's host name resolves to, IPv4 is preferred
+// unless the address family is forced
+func (s *Server) ResolveIP(ctx context.Context) (string, error) {
+	serverUrl, err := s.GetURL()
+	if err != nil {
+		return "", err
 	}
 
-	ips, err := net.LookupIP(serverUrl.Host)
+	ips, err := net.DefaultResolver.LookupIP(ctx, s.ipNetwork(), serverUrl.Hostname())
 	if err != nil {
-		fmt.Printf("Could not get IPs: %v\n", err)
+		log.Debugf("Could not get IPs: %v", err)
+		return "", err
 	}
 	var serverIP string
 	for _, ip := range ips {
 		if ipv4 := ip.To4(); ipv4 != nil {
 			serverIP = ipv4.String()
+			break
+		} else if serverIP == "" {
+			serverIP = ip.String()
 		}
 	}
+	return serverIP, nil
+}
+
+// Locate returns the server's location as "latitude,longitude", looking it up on the first call.
+// An empty location is returned when the server can't be located
+func (s *Server) Locate(ctx context.Context) (string, error) {
+	if s.Location != "" {
+		return s.Location, nil
+	}
 
-	serverQuery, err := url.JoinPath("https://ipinfo.io/", serverIP, "/json")
+	serverIP, err := s.ResolveIP(ctx)
 	if err != nil {
-		log.Debugf("Failed getting IP Info: %s", err)
-		return nil, err
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", nil
 	}
-	resp, err = http.Get(serverQuery)
+	info, err := s.geoProvider().Lookup(ctx, serverIP)
 	if err != nil {
-		log.Debugf("Failed getting IP Info: %s", err)
-		return nil, err
+		return "", err
 	}
-	defer resp.Body.Close()
-	body, err = io.ReadAll(resp.Body)
+	s.Location = info.Location
+	return s.Location, nil
+}
 
-	var serverInfo IPInfoResponse
-	if len(body) > 0 {
-		if err := json.Unmarshal(body, &serverInfo); err != nil {
-			log.Debugf("Failed when parsing get IP result: %s", err)
-			log.Debugf("Received payload: %s", body)
-		}
+// geoProvider returns s.Geo, or ipinfo.io through the server's HTTP client when it is nil
+func (s *Server) geoProvider() GeoProvider {
+	if s.Geo != nil {
+		return s.Geo
 	}
+	return &IPInfoProvider{Client: s.GetHTTPClient()}
+}
 
-	var processedString string
-	if clientInfo.IP != "" {
-		processedString = clientInfo.IP
+// Emit sends an event to s.Events, if set
+func (s *Server) Emit(e Event) {
+	if s.Events == nil {
+		return
 	}
-	if clientInfo.Organization != "" {
-		processedString = processedString + " - " + clientInfo.Organization
+	if e.Time.IsZero() {
+		e.Time = time.Now()
 	}
-	if clientInfo.Country != "" {
-		processedString = processedString + ", " + clientInfo.Country
+	if e.IPVersion == 0 {
+		e.IPVersion = s.IPVersion
 	}
-	distance := calculateDistance(clientInfo.Location, serverInfo.Location, distanceUnit)
-	if distance != "" {
-		processedString = processedString + " (" + distance + ")"
+	if e.Server == "" {
+		e.Server = s.Name
 	}
+	s.Events.HandleEvent(e)
+}
 
-	return &GetIPResult{ProcessedString: processedString, RawISPInfo: clientInfo}, nil
+// sampleThroughput periodically emits the speed measured by counter until the returned function is called
+func (s *Server) sampleThroughput(phase Phase, counter *BytesCounter) func() {
+	if s.Events == nil {
+		return func() {}
+	}
+
+	interval := s.EventInterval
+	if interval <= 0 {
+		interval = DefaultEventInterval
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				s.Emit(Event{
+					Type:  EventThroughputSample,
+					Phase: phase,
+					Bytes: counter.Total(),
+					Speed: counter.AvgBytes(),
+				})
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// ipNetwork returns the network name used for resolving the server and ICMP pings
+func (s *Server) ipNetwork() string {
+	switch s.IPVersion {
+	case 4:
+		return "ip4"
+	case 6:
+		return "ip6"
+	default:
+		return "ip"
+	}
+}
+
+// GetHTTPClient returns the HTTP client used to talk to the server
+func (s *Server) GetHTTPClient() *http.Client {
+	if s.HTTPClient != nil {
+		return s.HTTPClient
+	}
+	return http.DefaultClient
 }
 
 // GetURL parses the server's URL into a url.URL
@@ -572,6 +647,23 @@ func parseLocationString(location string) (haversine.Coord, error) {
 	return coord, nil
 }
 
+// DistanceKm returns the distance between two "latitude,longitude" locations in kilometres
+func DistanceKm(from string, to string) (float64, error) {
+	if from == "" || to == "" {
+		return 0, errors.New("unknown location")
+	}
+	fromCoord, err := parseLocationString(from)
+	if err != nil {
+		return 0, err
+	}
+	toCoord, err := parseLocationString(to)
+	if err != nil {
+		return 0, err
+	}
+	_, km := haversine.Distance(fromCoord, toCoord)
+	return km, nil
+}
+
 func calculateDistance(serverLocation string, clientLocation string, unit string) string {
 	serverCoord, err := parseLocationString(serverLocation)
 	if err != nil {
@@ -584,17 +676,25 @@ func calculateDistance(serverLocation string, clientLocation string, unit string
 		return ""
 	}
 
-	dist, km := haversine.Distance(clientCoord, serverCoord)
-	unitString := " mi"
+	_, km := haversine.Distance(clientCoord, serverCoord)
+	if unit != "km" && unit != "NM" {
+		unit = "mi"
+	}
+	return fmt.Sprintf("%.2f %s", ConvertDistance(km, unit), unit)
+}
 
+// ConvertDistance converts kilometres to the given unit, "km", "NM" or miles for anything else
+func ConvertDistance(km float64, unit string) float64 {
 	switch unit {
 	case "km":
-		dist = km
-		unitString = " km"
+		return km
 	case "NM":
-		dist = km * 0.539957
-		unitString = " NM"
+		return km * 0.539957
 	}
+	return km * 0.621371
+}
 
-	return fmt.Sprintf("%.2f%s", dist, unitString)
+// DistanceToKm converts a distance in the given unit to kilometres, the inverse of ConvertDistance
+func DistanceToKm(distance float64, unit string) float64 {
+	return distance / ConvertDistance(1, unit)
 }
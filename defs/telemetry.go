@@ -5,6 +5,7 @@ import (
 	"net/url"
 	"path"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,19 +16,36 @@ const (
 	TelemetryLevelDebug    = "debug"
 )
 
-// TelemetryLog is the logger for `log` field in telemetry data
+// TelemetryLog is the logger for `log` field in telemetry data. It is safe for concurrent use, as the
+// tests of a server may run at the same time, and a nil log discards everything
 type TelemetryLog struct {
+	lock    *sync.Mutex
 	level   int
 	content []string
 }
 
+// NewTelemetryLog creates a log at the given level
+func NewTelemetryLog(level int) *TelemetryLog {
+	return &TelemetryLog{
+		lock:  &sync.Mutex{},
+		level: level,
+	}
+}
+
 // SetLevel sets the log level
 func (t *TelemetryLog) SetLevel(level int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	t.level = level
 }
 
 // Logf logs when log level is higher than or equal to "full"
 func (t *TelemetryLog) Logf(format string, a ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	if t.level >= 2 {
 		t.content = append(
 			t.content,
@@ -42,6 +60,11 @@ func (t *TelemetryLog) Logf(format string, a ...interface{}) {
 
 // Warnf logs when log level is higher than or equal to "full", with a WARN prefix
 func (t *TelemetryLog) Warnf(format string, a ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	if t.level >= 2 {
 		t.content = append(
 			t.content,
@@ -56,6 +79,11 @@ func (t *TelemetryLog) Warnf(format string, a ...interface{}) {
 
 // Verbosef logs when log level is higher than or equal to "debug"
 func (t *TelemetryLog) Verbosef(format string, a ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	if t.level >= 3 {
 		t.content = append(
 			t.content,
@@ -70,6 +98,11 @@ func (t *TelemetryLog) Verbosef(format string, a ...interface{}) {
 
 // String returns the concatenated string of field `content`
 func (t *TelemetryLog) String() string {
+	if t == nil {
+		return ""
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	return strings.Join(t.content, "\n")
 }
 
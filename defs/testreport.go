@@ -1,6 +1,7 @@
 package defs
 
 import (
+	"math"
 	"time"
 )
 
@@ -16,6 +17,97 @@ type Report struct {
 	Upload        float64   `json:"upload"`
 	Download      float64   `json:"download"`
 	ShareLink     string    `json:"share_link"`
+	IPVersion     int       `json:"ip_version,omitempty"`
+
+	// DownloadLatency and UploadLatency hold the latency measured while the link was loaded
+	DownloadLatency *LatencyStats `json:"download_latency,omitempty"`
+	UploadLatency   *LatencyStats `json:"upload_latency,omitempty"`
+	Bufferbloat     string        `json:"bufferbloat,omitempty"`
+
+	// DownloadStats and UploadStats hold the throughput sampled over the download and the upload
+	DownloadStats *ThroughputStats `json:"download_stats,omitempty"`
+	UploadStats   *ThroughputStats `json:"upload_stats,omitempty"`
+
+	// DownloadDuration and UploadDuration hold how long the tests were timed in seconds, the converged
+	// flags whether they were stopped early because the throughput was stable
+	DownloadDuration  float64 `json:"download_duration,omitempty"`
+	DownloadConverged bool    `json:"download_converged,omitempty"`
+	UploadDuration    float64 `json:"upload_duration,omitempty"`
+	UploadConverged   bool    `json:"upload_converged,omitempty"`
+
+	// Bidirectional holds the results of the download and upload run at the same time, nil when it was not run
+	Bidirectional *Bidirectional `json:"bidirectional,omitempty"`
+
+	// Tuning holds the parameters picked by the auto-tune, nil when it was not run
+	Tuning *Tuning `json:"tuning,omitempty"`
+
+	// Responsiveness holds the results of the responsiveness test, nil when it was not run
+	Responsiveness *Responsiveness `json:"responsiveness,omitempty"`
+
+	// IPv4 and IPv6 hold the results of a dual-stack test, run once over each address family
+	IPv4 *Report `json:"ipv4,omitempty"`
+	IPv6 *Report `json:"ipv6,omitempty"`
+}
+
+// Bidirectional represents the results of the download and the upload run at the same time,
+// speeds are in Mbps
+type Bidirectional struct {
+	Download      float64 `json:"download"`
+	Upload        float64 `json:"upload"`
+	BytesReceived int     `json:"bytes_received"`
+	BytesSent     int     `json:"bytes_sent"`
+	// Latency is the latency measured while both directions were loaded
+	Latency *LatencyStats `json:"latency,omitempty"`
+}
+
+// Tuning represents the transfer parameters picked by the auto-tune
+type Tuning struct {
+	DownloadRequests int          `json:"download_requests,omitempty"`
+	UploadRequests   int          `json:"upload_requests,omitempty"`
+	Chunks           int          `json:"chunks"`
+	UploadSize       int          `json:"upload_size"`
+	Steps            []TuningStep `json:"steps"`
+}
+
+// TuningStep represents a single probe of the auto-tune
+type TuningStep struct {
+	Phase    Phase   `json:"phase"`
+	Requests int     `json:"requests"`
+	Mbps     float64 `json:"mbps"`
+}
+
+// Responsiveness represents the responsiveness of a connection under load, latencies are in milliseconds
+type Responsiveness struct {
+	// RPM is the number of round trips per minute the connection sustains while saturated
+	RPM    float64 `json:"rpm"`
+	Rating string  `json:"rating"`
+	// TCPHandshake, TLSHandshake and HTTPLatency are measured on fresh connections
+	TCPHandshake float64 `json:"tcp_handshake"`
+	TLSHandshake float64 `json:"tls_handshake"`
+	HTTPLatency  float64 `json:"http_latency"`
+	// InConnectionLatency is measured on the load-generating connections
+	InConnectionLatency float64 `json:"in_connection_latency"`
+	// Connections is the number of load-generating connections that were used
+	Connections int `json:"connections"`
+	// DownloadMbps and UploadMbps are the throughput while the latency was probed, after the ramp-up
+	DownloadMbps float64 `json:"download_mbps"`
+	UploadMbps   float64 `json:"upload_mbps"`
+	// Saturated reports whether the throughput stabilised before the ramp-up deadline
+	Saturated bool `json:"saturated"`
+}
+
+// ResponsivenessRating rates the RPM the same way as common responsiveness tests do
+func ResponsivenessRating(rpm float64) string {
+	switch {
+	case rpm <= 0:
+		return ""
+	case rpm < 300:
+		return "Low"
+	case rpm < 1000:
+		return "Medium"
+	default:
+		return "High"
+	}
 }
 
 // FlatReport represents the output data fields in a flat file data such as CSV.
@@ -34,6 +126,84 @@ type FlatReport struct {
 // Client represents the speed test client's information
 type Client struct {
 	IPInfoResponse
+	SourceIP  string `json:"source_ip,omitempty"`
+	Interface string `json:"interface,omitempty"`
+}
+
+// Summary represents the aggregate of the reports of a multi-server test
+type Summary struct {
+	// Servers is the number of servers tested successfully, Failed the number of servers whose test failed
+	Servers int `json:"servers"`
+	Failed  int `json:"failed"`
+	// Parallel reports whether the servers were tested at the same time
+	Parallel bool         `json:"parallel"`
+	Ping     SummaryStats `json:"ping"`
+	Jitter   SummaryStats `json:"jitter"`
+	Download SummaryStats `json:"download"`
+	Upload   SummaryStats `json:"upload"`
+}
+
+// SummaryStats represents a single value aggregated over the servers of a multi-server test
+type SummaryStats struct {
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+	Mean float64 `json:"mean"`
+	// Total is the sum over all servers, which is the combined speed when they were tested in parallel
+	Total float64 `json:"total"`
+}
+
+// Summarize aggregates the reports of a multi-server test, dual-stack reports count once per address family
+func Summarize(reports []Report) Summary {
+	var pings, jitters, downloads, uploads []float64
+	for _, report := range reports {
+		for _, rep := range report.StackReports() {
+			pings = append(pings, rep.Ping)
+			jitters = append(jitters, rep.Jitter)
+			downloads = append(downloads, rep.Download)
+			uploads = append(uploads, rep.Upload)
+		}
+	}
+
+	return Summary{
+		Servers:  len(reports),
+		Ping:     newSummaryStats(pings),
+		Jitter:   newSummaryStats(jitters),
+		Download: newSummaryStats(downloads),
+		Upload:   newSummaryStats(uploads),
+	}
+}
+
+// newSummaryStats aggregates the given values
+func newSummaryStats(values []float64) SummaryStats {
+	if len(values) == 0 {
+		return SummaryStats{}
+	}
+
+	stats := SummaryStats{Min: values[0], Max: values[0]}
+	for _, v := range values {
+		stats.Min = math.Min(stats.Min, v)
+		stats.Max = math.Max(stats.Max, v)
+		stats.Total += v
+	}
+	stats.Mean = stats.Total / float64(len(values))
+	return stats
+}
+
+// StackReports returns the per address family reports of a dual-stack test,
+// or the report itself for any other test
+func (r Report) StackReports() []Report {
+	if r.IPv4 == nil && r.IPv6 == nil {
+		return []Report{r}
+	}
+
+	var reports []Report
+	if r.IPv4 != nil {
+		reports = append(reports, *r.IPv4)
+	}
+	if r.IPv6 != nil {
+		reports = append(reports, *r.IPv6)
+	}
+	return reports
 }
 
 func (r Report) GetFlatReport() FlatReport {
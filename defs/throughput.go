@@ -0,0 +1,167 @@
+package defs
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// DefaultSampleInterval is the default interval between two recorded throughput samples
+const DefaultSampleInterval = 100 * time.Millisecond
+
+// AggregationWindowLength is the length of the window used by AggregationWindow
+const AggregationWindowLength = 2 * time.Second
+
+// Aggregation represents the method used to calculate the reported speed from the throughput samples
+type Aggregation string
+
+const (
+	// AggregationMean divides the bytes transferred after the warmup by the time they took
+	AggregationMean Aggregation = "mean"
+	// AggregationTrimmed averages the samples, leaving out the fastest and the slowest 10%
+	AggregationTrimmed Aggregation = "trimmed"
+	// AggregationWindow reports the fastest speed sustained for AggregationWindowLength, like the LibreSpeed web UI
+	AggregationWindow Aggregation = "window"
+)
+
+// Aggregations lists the supported aggregation methods
+var Aggregations = []Aggregation{AggregationMean, AggregationTrimmed, AggregationWindow}
+
+// ParseAggregation returns the aggregation method with the given name, an empty name means AggregationMean
+func ParseAggregation(name string) (Aggregation, error) {
+	if name == "" {
+		return AggregationMean, nil
+	}
+	for _, a := range Aggregations {
+		if string(a) == name {
+			return a, nil
+		}
+	}
+	return "", fmt.Errorf("unknown aggregation method %q, use one of %v", name, Aggregations)
+}
+
+// ThroughputSample represents the throughput measured during a single sample interval
+type ThroughputSample struct {
+	// Time is the end of the sample interval in seconds since the test started
+	Time float64 `json:"time"`
+	// Bytes is the amount of bytes transferred since the test started
+	Bytes int `json:"bytes"`
+	// Speed is the throughput during the sample interval in Mbps
+	Speed float64 `json:"speed"`
+	// Warmup is set for the samples recorded during the warmup, which are left out of the statistics
+	Warmup bool `json:"warmup,omitempty"`
+}
+
+// ThroughputStats represents the throughput of a download or upload test over time, speeds are in Mbps
+type ThroughputStats struct {
+	Samples []ThroughputSample `json:"samples"`
+	Min     float64            `json:"min"`
+	Max     float64            `json:"max"`
+	Median  float64            `json:"median"`
+	P90     float64            `json:"p90"`
+}
+
+// NewThroughputStats calculates the statistics of the samples recorded after the warmup,
+// nil is returned when there are none
+func NewThroughputStats(samples []ThroughputSample) *ThroughputStats {
+	speeds := measuredSpeeds(samples)
+	if len(speeds) == 0 {
+		return nil
+	}
+	sort.Float64s(speeds)
+
+	return &ThroughputStats{
+		Samples: samples,
+		Min:     speeds[0],
+		Max:     speeds[len(speeds)-1],
+		Median:  percentile(speeds, 50),
+		P90:     percentile(speeds, 90),
+	}
+}
+
+// percentile returns the p-th percentile of sorted values, interpolating between the closest ranks
+func percentile(sorted []float64, p float64) float64 {
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+// Aggregate calculates the speed in Mbps from the samples recorded after the warmup using the given
+// method. ok is false when there are not enough samples, AggregationMean always reports false as it
+// is calculated from the exact byte count instead
+func Aggregate(method Aggregation, samples []ThroughputSample) (mbps float64, ok bool) {
+	switch method {
+	case AggregationTrimmed:
+		speeds := measuredSpeeds(samples)
+		if len(speeds) == 0 {
+			return 0, false
+		}
+		sort.Float64s(speeds)
+		trim := len(speeds) / 10
+		return getAvg(speeds[trim : len(speeds)-trim]), true
+	case AggregationWindow:
+		return fastestWindow(samples, AggregationWindowLength)
+	default:
+		return 0, false
+	}
+}
+
+// fastestWindow returns the highest average speed in Mbps sustained for the length of window after the
+// warmup. The whole measured period is used when it is shorter than window
+func fastestWindow(samples []ThroughputSample, window time.Duration) (float64, bool) {
+	// the last warmup sample, or the start of the test, is where the measured period begins
+	points := []ThroughputSample{{}}
+	for _, sample := range samples {
+		if sample.Warmup {
+			points[0] = sample
+		} else {
+			points = append(points, sample)
+		}
+	}
+	if len(points) < 2 {
+		return 0, false
+	}
+
+	speed := func(from, to ThroughputSample) float64 {
+		return float64(to.Bytes-from.Bytes) * 8 / (to.Time - from.Time) / 1000 / 1000
+	}
+
+	var fastest float64
+	var found bool
+	j := 1
+	for i := range points {
+		for j < len(points) && points[j].Time-points[i].Time < window.Seconds() {
+			j++
+		}
+		if j == len(points) {
+			break
+		}
+		fastest = math.Max(fastest, speed(points[i], points[j]))
+		found = true
+	}
+	if !found {
+		return speed(points[0], points[len(points)-1]), true
+	}
+	return fastest, true
+}
+
+// sampleInterval returns the given sample interval, or DefaultSampleInterval when it is not positive
+func sampleInterval(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return DefaultSampleInterval
+	}
+	return interval
+}
+
+// measuredSpeeds returns the speeds of the samples recorded after the warmup
+func measuredSpeeds(samples []ThroughputSample) []float64 {
+	var speeds []float64
+	for _, sample := range samples {
+		if !sample.Warmup {
+			speeds = append(speeds, sample.Speed)
+		}
+	}
+	return speeds
+}
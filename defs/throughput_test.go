@@ -0,0 +1,123 @@
+package defs
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// constantSamples returns samples every second from first to last, at the given speed in Mbps
+func constantSamples(first, last int, mbps float64) []ThroughputSample {
+	var samples []ThroughputSample
+	for i := first; i <= last; i++ {
+		samples = append(samples, ThroughputSample{
+			Time:  float64(i),
+			Bytes: int(mbps * float64(i) * 125000),
+			Speed: mbps,
+		})
+	}
+	return samples
+}
+
+// burstSamples holds a second of 1 Mbps, two seconds of 20 Mbps and two more of 1 Mbps
+var burstSamples = []ThroughputSample{
+	{Time: 1, Bytes: 125000, Speed: 1},
+	{Time: 2, Bytes: 250000, Speed: 1},
+	{Time: 3, Bytes: 2750000, Speed: 20},
+	{Time: 4, Bytes: 5250000, Speed: 20},
+	{Time: 5, Bytes: 5375000, Speed: 1},
+	{Time: 6, Bytes: 5500000, Speed: 1},
+}
+
+func TestPercentile(t *testing.T) {
+	tests := []struct {
+		name   string
+		sorted []float64
+		p      float64
+		want   float64
+	}{
+		{"single value", []float64{5}, 90, 5},
+		{"minimum", []float64{1, 2, 3, 4}, 0, 1},
+		{"maximum", []float64{1, 2, 3, 4}, 100, 4},
+		{"median of even count", []float64{1, 2, 3, 4}, 50, 2.5},
+		{"median of odd count", []float64{1, 2, 10}, 50, 2},
+		{"interpolated", []float64{1, 2, 3, 4}, 90, 3.7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := percentile(tt.sorted, tt.p); !almostEqual(got, tt.want) {
+				t.Errorf("got %f, want %f", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFastestWindow(t *testing.T) {
+	warmup := ThroughputSample{Time: 1, Bytes: 12500000, Speed: 100, Warmup: true}
+
+	tests := []struct {
+		name    string
+		samples []ThroughputSample
+		want    float64
+		ok      bool
+	}{
+		{"no samples", nil, 0, false},
+		{"only warmup", []ThroughputSample{warmup}, 0, false},
+		{"constant", constantSamples(1, 10, 10), 10, true},
+		{"burst", burstSamples, 20, true},
+		{"shorter than the window", constantSamples(1, 1, 8), 8, true},
+		// the measured period starts at the warmup sample, so its bytes don't count
+		{"after the warmup", []ThroughputSample{
+			warmup,
+			{Time: 2, Bytes: 12500000 + 500000, Speed: 4},
+			{Time: 3, Bytes: 12500000 + 1000000, Speed: 4},
+			{Time: 4, Bytes: 12500000 + 1500000, Speed: 4},
+		}, 4, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := fastestWindow(tt.samples, 2*time.Second)
+			if ok != tt.ok || !almostEqual(got, tt.want) {
+				t.Errorf("got %f, %v, want %f, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	var ramp []ThroughputSample
+	for i := 1; i <= 20; i++ {
+		ramp = append(ramp, ThroughputSample{Time: float64(i), Speed: float64(i)})
+	}
+
+	tests := []struct {
+		name    string
+		method  Aggregation
+		samples []ThroughputSample
+		want    float64
+		ok      bool
+	}{
+		{"mean", AggregationMean, burstSamples, 0, false},
+		{"unset", "", burstSamples, 0, false},
+		{"trimmed", AggregationTrimmed, ramp, 10.5, true},
+		{"trimmed too few to trim", AggregationTrimmed, ramp[:3], 2, true},
+		{"trimmed without samples", AggregationTrimmed, nil, 0, false},
+		{"trimmed skips the warmup", AggregationTrimmed, []ThroughputSample{
+			{Time: 1, Speed: 100, Warmup: true},
+			{Time: 2, Speed: 4},
+		}, 4, true},
+		{"window", AggregationWindow, burstSamples, 20, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Aggregate(tt.method, tt.samples)
+			if ok != tt.ok || !almostEqual(got, tt.want) {
+				t.Errorf("got %f, %v, want %f, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func almostEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
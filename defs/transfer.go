@@ -0,0 +1,300 @@
+package defs
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// TransferOptions holds the parameters of a download or upload test
+type TransferOptions struct {
+	// Requests is the number of concurrent HTTP requests
+	Requests int
+	// Chunks is the number of chunks requested from the server per download request
+	Chunks int
+	// UploadSize is the size of the upload payload in KiB
+	UploadSize int
+	// NoPrealloc disables pre-allocation of the upload payload
+	NoPrealloc bool
+	// Duration is the length of the test, or its maximum length when EarlyStop is set
+	Duration time.Duration
+	// LatencyInterval is the interval between latency probes sent while transferring, zero disables them
+	LatencyInterval time.Duration
+	// Warmup is the time after the start whose bytes are left out of the speed, the test is timed
+	// from the end of the warmup
+	Warmup time.Duration
+	// Aggregation is the method used to calculate the speed, AggregationMean is used when empty
+	Aggregation Aggregation
+	// SampleInterval is the interval between recorded throughput samples, DefaultSampleInterval is used when zero
+	SampleInterval time.Duration
+	// EarlyStop ends the test as soon as the throughput is stable, nil runs the test for the whole Duration
+	EarlyStop *EarlyStop
+	// Phase tags the throughput samples emitted during the test, the phase of the direction is used when empty
+	Phase Phase
+}
+
+// EarlyStop holds the parameters of the early stop. The speed measured over every sample interval is
+// averaged over the last Window, and the test stops once that average has stayed within Tolerance of its
+// latest value for another Window, but never before MinDuration. Zero values are replaced by the defaults
+type EarlyStop struct {
+	// Tolerance is the allowed relative deviation, e.g. 0.05 for 5%
+	Tolerance float64
+	// Window is how long the speed has to stay within the tolerance
+	Window time.Duration
+	// MinDuration is the shortest test, not counting the warmup
+	MinDuration time.Duration
+}
+
+// Defaults of the early stop
+const (
+	DefaultStableTolerance = 0.05
+	DefaultStableWindow    = 2 * time.Second
+	DefaultMinDuration     = 3 * time.Second
+)
+
+// withDefaults returns a copy of the early stop parameters with the zero values replaced by the defaults
+func (e EarlyStop) withDefaults() EarlyStop {
+	if e.Tolerance <= 0 {
+		e.Tolerance = DefaultStableTolerance
+	}
+	if e.Window <= 0 {
+		e.Window = DefaultStableWindow
+	}
+	if e.MinDuration <= 0 {
+		e.MinDuration = DefaultMinDuration
+	}
+	return e
+}
+
+// TransferResult holds the results of a download or upload test
+type TransferResult struct {
+	// Mbps is the average transfer speed
+	Mbps float64
+	// Bytes is the total amount of bytes transferred
+	Bytes int
+	// Latency is the latency measured while transferring, nil when it was not measured
+	Latency *LatencyStats
+	// Stats holds the throughput sampled over the test
+	Stats *ThroughputStats
+	// Duration is how long the test was timed, not counting the warmup
+	Duration time.Duration
+	// Converged reports whether the test was stopped early because the throughput was stable
+	Converged bool
+}
+
+// BidirectionalResult holds the results of a download and an upload test run at the same time
+type BidirectionalResult struct {
+	Download *TransferResult
+	Upload   *TransferResult
+	// Latency is the latency measured while both directions were loaded, nil when it was not measured
+	Latency *LatencyStats
+}
+
+// ManualBidirectional runs the download and the upload test at the same time, emitting throughput
+// samples of both to s.Events. The latency is probed once for the combined load at the download's
+// LatencyInterval, the early stop is disabled so both directions stay loaded for the whole test
+func (s *Server) ManualBidirectional(
+	ctx context.Context,
+	downloadOpts TransferOptions,
+	uploadOpts TransferOptions,
+) (*BidirectionalResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	latencyInterval := downloadOpts.LatencyInterval
+	downloadOpts.LatencyInterval, uploadOpts.LatencyInterval = 0, 0
+	downloadOpts.EarlyStop, uploadOpts.EarlyStop = nil, nil
+
+	var stopProbing func() *LatencyStats
+	if latencyInterval > 0 {
+		stopProbing = s.probeLatency(ctx, latencyInterval)
+	}
+
+	var result BidirectionalResult
+	var downloadErr, uploadErr error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if result.Download, downloadErr = s.ManualDownload(ctx, downloadOpts); downloadErr != nil {
+			// a failed direction ends the other one as well
+			cancel()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if result.Upload, uploadErr = s.ManualUpload(ctx, uploadOpts); uploadErr != nil {
+			cancel()
+		}
+	}()
+	wg.Wait()
+
+	if stopProbing != nil {
+		result.Latency = stopProbing()
+	}
+	// report the error that ended the test rather than the cancellation it caused
+	for _, err := range []error{downloadErr, uploadErr} {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return nil, err
+		}
+	}
+	if downloadErr != nil {
+		return nil, downloadErr
+	}
+	if uploadErr != nil {
+		return nil, uploadErr
+	}
+	return &result, nil
+}
+
+// runTransfer keeps opts.Requests transfers running for opts.Warmup and then opts.Duration, the
+// connections are started 200ms apart. transfer performs a single request and reports whether it finished
+// normally and should be replaced by a new one
+func (s *Server) runTransfer(
+	ctx context.Context,
+	phase Phase,
+	counter *BytesCounter,
+	opts TransferOptions,
+	transfer func(ctx context.Context) bool,
+) (*TransferResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if opts.Phase != "" {
+		phase = opts.Phase
+	}
+
+	transferDone := make(chan struct{}, opts.Requests)
+	doTransfer := func() {
+		if transfer(ctx) {
+			transferDone <- struct{}{}
+		}
+	}
+
+	counter.SetWarmup(opts.Warmup)
+	counter.Start()
+	warmup := time.After(opts.Warmup)
+	counter.StartSampling(opts.SampleInterval)
+	defer counter.StopSampling()
+	stopEvents := s.sampleThroughput(phase, counter)
+	defer stopEvents()
+
+	var stopProbing func() *LatencyStats
+	if opts.LatencyInterval > 0 {
+		stopProbing = s.probeLatency(ctx, opts.LatencyInterval)
+	}
+
+	for i := 0; i < opts.Requests; i++ {
+		go doTransfer()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+	// the test is timed once all the requests have started and the warmup is over
+	var timeout, check <-chan time.Time
+	var timed time.Time
+	var converged bool
+	var stability *stabilityCheck
+	var lastCheck time.Time
+	var lastBytes int
+Loop:
+	for {
+		select {
+		case <-warmup:
+			warmup = nil
+			timed = time.Now()
+			timeout = time.After(opts.Duration)
+			if opts.EarlyStop != nil {
+				stability = &stabilityCheck{EarlyStop: opts.EarlyStop.withDefaults(), start: timed}
+				lastCheck, lastBytes = timed, counter.Total()
+				ticker := time.NewTicker(sampleInterval(opts.SampleInterval))
+				defer ticker.Stop()
+				check = ticker.C
+			}
+		case <-timeout:
+			break Loop
+		case now := <-check:
+			total := counter.Total()
+			mbps := float64(total-lastBytes) * 8 / now.Sub(lastCheck).Seconds() / 1000 / 1000
+			lastCheck, lastBytes = now, total
+			if stability.add(now, mbps) {
+				converged = true
+				break Loop
+			}
+		case <-ctx.Done():
+			// the caller's context was cancelled before the test finished
+			return nil, ctx.Err()
+		case <-transferDone:
+			go doTransfer()
+		}
+	}
+
+	counter.StopSampling()
+	samples := counter.Samples()
+	result := TransferResult{
+		Mbps:      counter.AvgMbps(),
+		Bytes:     counter.Total(),
+		Stats:     NewThroughputStats(samples),
+		Duration:  time.Since(timed),
+		Converged: converged,
+	}
+	if mbps, ok := Aggregate(opts.Aggregation, samples); ok {
+		result.Mbps = mbps
+	}
+	if stopProbing != nil {
+		result.Latency = stopProbing()
+	}
+	return &result, nil
+}
+
+// stabilityCheck decides when the early stop ends a test
+type stabilityCheck struct {
+	EarlyStop
+	start time.Time
+	// intervals holds the speeds of the sample intervals within the last Window
+	intervals []stabilitySample
+	// history holds the averages of the intervals, back to one that covers the start of the Window
+	history []stabilitySample
+}
+
+// stabilitySample is a speed at a point of the test
+type stabilitySample struct {
+	time time.Time
+	mbps float64
+}
+
+// add records the speed over the sample interval ending at now and reports whether the test can stop.
+// The speed of a single interval swings widely, so the average of the last Window is checked instead
+func (c *stabilityCheck) add(now time.Time, mbps float64) bool {
+	windowStart := now.Add(-c.Window)
+	c.intervals = append(c.intervals, stabilitySample{now, mbps})
+	for !c.intervals[0].time.After(windowStart) {
+		c.intervals = c.intervals[1:]
+	}
+	var sum float64
+	for _, interval := range c.intervals {
+		sum += interval.mbps
+	}
+	average := sum / float64(len(c.intervals))
+	c.history = append(c.history, stabilitySample{now, average})
+
+	// forget the averages that don't matter for the window anymore, keeping one that covers its start
+	for len(c.history) > 1 && !c.history[1].time.After(windowStart) {
+		c.history = c.history[1:]
+	}
+
+	// the oldest average compared has to cover a whole window of intervals itself
+	if now.Sub(c.start) < c.MinDuration || c.history[0].time.After(windowStart) ||
+		c.history[0].time.Sub(c.start) < c.Window || average <= 0 {
+		return false
+	}
+	for _, sample := range c.history {
+		if math.Abs(sample.mbps-average)/average > c.Tolerance {
+			return false
+		}
+	}
+	return true
+}
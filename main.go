@@ -4,7 +4,9 @@ Copyright © 2023 NAME HERE <EMAIL ADDRESS>
 package main
 
 import (
+	"context"
 	"os"
+	"os/signal"
 
 	"github.com/czechbol/librespeedtest/cmd"
 	log "github.com/sirupsen/logrus"
@@ -14,7 +16,11 @@ func main() {
 	log.SetOutput(os.Stdout)
 	log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
 
-	if err := (&cmd.CLIOptions{}).CobraCommand().Execute(); err != nil {
+	// cancel a running test cleanly on Ctrl+C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := (&cmd.CLIOptions{}).CobraCommand().ExecuteContext(ctx); err != nil {
 		log.Error(err)
 	}
 }
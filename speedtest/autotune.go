@@ -0,0 +1,142 @@
+package speedtest
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/czechbol/librespeedtest/defs"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultTuneProbeDuration is the default length of a single auto-tune probe
+	DefaultTuneProbeDuration = 2 * time.Second
+	// DefaultTuneMaxRequests is the default maximum number of parallel requests tried by the auto-tune
+	DefaultTuneMaxRequests = 32
+	// DefaultTuneMinGain is the default relative speed gain an extra step of requests has to bring
+	DefaultTuneMinGain = 0.1
+
+	// tuneRequestTime is how long a single download request should last with the tuned chunk count
+	tuneRequestTime = 4 * time.Second
+	// tuneMinChunks and tuneMaxChunks limit the tuned chunk count, LibreSpeed backends cap it at 1024
+	tuneMinChunks = 10
+	tuneMaxChunks = 1024
+	// tuneMinUploadSize and tuneMaxUploadSize limit the tuned upload payload size in KiB
+	tuneMinUploadSize = 256
+	tuneMaxUploadSize = 16 * 1024
+)
+
+// TuneOptions holds the parameters of the auto-tune
+type TuneOptions struct {
+	// NoDownload and NoUpload skip tuning a direction
+	NoDownload bool
+	NoUpload   bool
+	// ProbeDuration is the length of a single probe, DefaultTuneProbeDuration is used when zero
+	ProbeDuration time.Duration
+	// MaxRequests is the maximum number of parallel requests tried, DefaultTuneMaxRequests is used when zero
+	MaxRequests int
+	// MinGain is the relative speed gain doubling the requests has to bring, DefaultTuneMinGain is used when zero
+	MinGain float64
+	// Transfer holds the remaining parameters of the probes
+	Transfer defs.TransferOptions
+}
+
+// AutoTune probes the link with short downloads and uploads, doubling the number of parallel requests
+// until the speed stops growing, and picks the chunk count and upload payload size to match
+func AutoTune(ctx context.Context, server *defs.Server, opts TuneOptions) (*defs.Tuning, error) {
+	if opts.ProbeDuration <= 0 {
+		opts.ProbeDuration = DefaultTuneProbeDuration
+	}
+	if opts.MaxRequests <= 0 {
+		opts.MaxRequests = DefaultTuneMaxRequests
+	}
+	if opts.MinGain <= 0 {
+		opts.MinGain = DefaultTuneMinGain
+	}
+
+	t := time.Now()
+	defer func() {
+		server.TLog.Logf("Auto-tune took %s", time.Now().Sub(t).String())
+	}()
+
+	tuning := defs.Tuning{
+		Chunks:     opts.Transfer.Chunks,
+		UploadSize: opts.Transfer.UploadSize,
+	}
+
+	if !opts.NoDownload {
+		requests, mbps, err := tuneRequests(ctx, server, defs.PhaseDownload, opts, &tuning)
+		if err != nil {
+			return nil, err
+		}
+		tuning.DownloadRequests = requests
+		// every request should last a while, so the connections aren't restarted all the time
+		perRequest := mbps / float64(requests) * 1000 * 1000 / 8
+		tuning.Chunks = clamp(int(perRequest*tuneRequestTime.Seconds()/(1<<20)), tuneMinChunks, tuneMaxChunks)
+	}
+	if !opts.NoUpload {
+		requests, mbps, err := tuneRequests(ctx, server, defs.PhaseUpload, opts, &tuning)
+		if err != nil {
+			return nil, err
+		}
+		tuning.UploadRequests = requests
+		// a payload of about a second per request keeps the payload rewinds rare
+		perRequest := mbps / float64(requests) * 1000 * 1000 / 8
+		tuning.UploadSize = clamp(int(perRequest/1024), tuneMinUploadSize, tuneMaxUploadSize)
+	}
+
+	return &tuning, nil
+}
+
+// tuneRequests doubles the parallel requests of the given phase until the speed gain falls under
+// opts.MinGain, and returns the best request count with its speed. The probes are recorded in tuning
+func tuneRequests(
+	ctx context.Context,
+	server *defs.Server,
+	phase defs.Phase,
+	opts TuneOptions,
+	tuning *defs.Tuning,
+) (int, float64, error) {
+	bestRequests, bestMbps := 0, 0.0
+	for requests := 1; requests <= opts.MaxRequests; requests *= 2 {
+		probeOpts := opts.Transfer
+		probeOpts.Requests = requests
+		probeOpts.Duration = opts.ProbeDuration
+		// the staggered starts and TCP slow start are left out of the probe
+		probeOpts.Warmup = time.Duration(requests)*200*time.Millisecond + 500*time.Millisecond
+		probeOpts.EarlyStop = nil
+		probeOpts.LatencyInterval = 0
+		// the probes' samples belong to the tuning, not to the tests that follow it
+		probeOpts.Phase = defs.PhaseTuning
+
+		var result *defs.TransferResult
+		var err error
+		if phase == defs.PhaseDownload {
+			result, err = server.ManualDownload(ctx, probeOpts)
+		} else {
+			result, err = server.ManualUpload(ctx, probeOpts)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+
+		log.Debugf("Auto-tune: %s with %d requests: %.2f Mbps", phase, requests, result.Mbps)
+		tuning.Steps = append(tuning.Steps, defs.TuningStep{
+			Phase:    phase,
+			Requests: requests,
+			Mbps:     result.Mbps,
+		})
+
+		if bestRequests > 0 && result.Mbps < bestMbps*(1+opts.MinGain) {
+			break
+		}
+		bestRequests, bestMbps = requests, result.Mbps
+	}
+	return bestRequests, bestMbps, nil
+}
+
+// clamp limits v to the range [min, max]
+func clamp(v, min, max int) int {
+	return int(math.Max(float64(min), math.Min(float64(max), float64(v))))
+}
@@ -0,0 +1,207 @@
+package speedtest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/czechbol/librespeedtest/defs"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultServerListTTL is the default time a cached server list is used without revalidating it
+const DefaultServerListTTL = 24 * time.Hour
+
+// ServerListCache keeps remote server lists on disk. A cached list is used as is until it is older
+// than TTL, then it is revalidated with ETag and If-Modified-Since. When the remote list can't be
+// fetched, a stale cached list is used instead
+type ServerListCache struct {
+	// Dir is where the lists are kept, DefaultCacheDir is used when empty
+	Dir string
+	// TTL is how long a cached list is used without revalidating it, zero always revalidates
+	TTL time.Duration
+	// Refresh fetches the lists again, ignoring what is cached
+	Refresh bool
+	// SkipInvalid leaves out the entries that don't describe a usable server instead of rejecting
+	// the whole list, see ParseServerListSkipInvalid
+	SkipInvalid bool
+}
+
+// cachedServerList is the on-disk form of a cached server list
+type cachedServerList struct {
+	URL          string          `json:"url"`
+	ETag         string          `json:"etag,omitempty"`
+	LastModified string          `json:"last_modified,omitempty"`
+	FetchedAt    time.Time       `json:"fetched_at"`
+	Servers      json.RawMessage `json:"servers"`
+}
+
+// DefaultCacheDir returns the librespeedtest directory in the user's cache directory,
+// which is $XDG_CACHE_HOME or ~/.cache on Linux
+func DefaultCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "librespeedtest"), nil
+}
+
+// Load reads a server list like LoadServerList, caching it when it comes from a URL
+func (c *ServerListCache) Load(ctx context.Context, client *http.Client, source string) (*[]defs.Server, error) {
+	if isRemoteList(source) {
+		return c.Fetch(ctx, client, source)
+	}
+	return GetLocalServerList(source)
+}
+
+// Fetch returns the server list at listURL, from the cache when it is fresh enough
+func (c *ServerListCache) Fetch(ctx context.Context, client *http.Client, listURL string) (*[]defs.Server, error) {
+	path, err := c.path(listURL)
+	if err != nil {
+		log.Debugf("Server list cache is unavailable: %s", err)
+		return fetchServerList(ctx, client, listURL, func(b []byte) ([]defs.Server, error) {
+			return c.parse(b, false)
+		})
+	}
+
+	cached, servers := c.read(path, listURL)
+	if servers != nil && !c.Refresh && time.Since(cached.FetchedAt) < c.TTL {
+		log.Debugf("Using the server list cached at %s", cached.FetchedAt.Format(time.RFC3339))
+		return &servers, nil
+	}
+
+	header := make(http.Header)
+	if servers != nil && !c.Refresh {
+		if cached.ETag != "" {
+			header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	resp, b, err := requestServerList(ctx, client, listURL, header)
+	if err == nil {
+		switch {
+		case resp.StatusCode == http.StatusNotModified && servers != nil:
+			log.Debug("Cached server list is still up to date")
+			cached.FetchedAt = time.Now()
+			c.write(path, cached)
+			return &servers, nil
+		case resp.StatusCode == http.StatusOK:
+			var fetched []defs.Server
+			if fetched, err = c.parse(b, false); err == nil {
+				c.write(path, cachedServerList{
+					URL:          listURL,
+					ETag:         resp.Header.Get("ETag"),
+					LastModified: resp.Header.Get("Last-Modified"),
+					FetchedAt:    time.Now(),
+					Servers:      b,
+				})
+				return &fetched, nil
+			}
+		default:
+			err = fmt.Errorf("fetching the server list failed with status %s", resp.Status)
+		}
+	}
+
+	if servers == nil || ctx.Err() != nil {
+		return nil, err
+	}
+	log.Warnf(
+		"Unable to fetch the server list (%s), using the copy cached at %s",
+		err,
+		cached.FetchedAt.Format(time.RFC3339),
+	)
+	return &servers, nil
+}
+
+// path returns the cache file of the list at listURL
+func (c *ServerListCache) path(listURL string) (string, error) {
+	dir := c.Dir
+	if dir == "" {
+		var err error
+		if dir, err = DefaultCacheDir(); err != nil {
+			return "", err
+		}
+	}
+	sum := sha256.Sum256([]byte(listURL))
+	return filepath.Join(dir, "servers-"+hex.EncodeToString(sum[:8])+".json"), nil
+}
+
+// read returns the cached list at path, the servers are nil when there is no usable copy
+func (c *ServerListCache) read(path string, listURL string) (cachedServerList, []defs.Server) {
+	var cached cachedServerList
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Debugf("Failed to read the cached server list: %s", err)
+		}
+		return cached, nil
+	}
+	if err := json.Unmarshal(b, &cached); err != nil || cached.URL != listURL {
+		log.Debugf("Ignoring the invalid cached server list %s", path)
+		return cached, nil
+	}
+	servers, err := c.parse(cached.Servers, true)
+	if err != nil {
+		log.Debugf("Ignoring the invalid cached server list %s: %s", path, err)
+		return cached, nil
+	}
+	return cached, servers
+}
+
+// parse decodes a server list, leaving out the invalid entries when SkipInvalid is set. They were
+// warned about when the list was fetched, so they are only logged at debug level for a cached list
+func (c *ServerListCache) parse(data []byte, cached bool) ([]defs.Server, error) {
+	switch {
+	case !c.SkipInvalid:
+		return ParseServerList(data)
+	case cached:
+		return parseServerList(data, func(err error) {
+			log.Debugf("Skipping %s", err)
+		})
+	default:
+		return ParseServerListSkipInvalid(data)
+	}
+}
+
+// write stores the list at path, failures are only logged as the cache is optional
+func (c *ServerListCache) write(path string, cached cachedServerList) {
+	b, err := json.Marshal(cached)
+	if err != nil {
+		log.Debugf("Failed to encode the server list cache: %s", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		log.Debugf("Failed to create the cache directory: %s", err)
+		return
+	}
+
+	// write to a temporary file first, so a concurrent run never reads half of the list
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		log.Debugf("Failed to write the server list cache: %s", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		log.Debugf("Failed to write the server list cache: %s", err)
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		log.Debugf("Failed to write the server list cache: %s", err)
+		return
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		log.Debugf("Failed to write the server list cache: %s", err)
+	}
+}
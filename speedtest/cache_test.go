@@ -0,0 +1,88 @@
+package speedtest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServerListCacheRevalidation(t *testing.T) {
+	const etag = `"v1"`
+	var requests, notModified int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get("If-None-Match") == etag {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(`[` + validServerJSON + `]`))
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name        string
+		cache       ServerListCache
+		requests    int32
+		notModified int32
+	}{
+		{"first fetch", ServerListCache{TTL: time.Hour}, 1, 0},
+		{"fresh copy", ServerListCache{TTL: time.Hour}, 1, 0},
+		{"revalidated", ServerListCache{}, 2, 1},
+		{"refresh", ServerListCache{TTL: time.Hour, Refresh: true}, 3, 1},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cache.Dir = dir
+			servers, err := tt.cache.Fetch(context.Background(), nil, ts.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := serverIDs(*servers); !equalInts(got, []int{1}) {
+				t.Errorf("got servers %v, want [1]", got)
+			}
+			if got := atomic.LoadInt32(&requests); got != tt.requests {
+				t.Errorf("the list was requested %d times, want %d", got, tt.requests)
+			}
+			if got := atomic.LoadInt32(&notModified); got != tt.notModified {
+				t.Errorf("the list was revalidated %d times, want %d", got, tt.notModified)
+			}
+		})
+	}
+}
+
+func TestServerListCacheStale(t *testing.T) {
+	var down int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`[` + validServerJSON + `]`))
+	}))
+	defer ts.Close()
+
+	cache := ServerListCache{Dir: t.TempDir()}
+	if _, err := cache.Fetch(context.Background(), nil, ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt32(&down, 1)
+	servers, err := cache.Fetch(context.Background(), nil, ts.URL)
+	if err != nil {
+		t.Fatalf("the stale copy wasn't used: %s", err)
+	}
+	if got := serverIDs(*servers); !equalInts(got, []int{1}) {
+		t.Errorf("got servers %v, want [1]", got)
+	}
+
+	empty := ServerListCache{Dir: t.TempDir()}
+	if _, err := empty.Fetch(context.Background(), nil, ts.URL); err == nil {
+		t.Error("fetching a failing list without a cached copy returned no error")
+	}
+}
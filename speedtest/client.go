@@ -0,0 +1,167 @@
+package speedtest
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ClientOptions configures the HTTP client returned by NewHTTPClient
+type ClientOptions struct {
+	// Timeout limits connecting to a server, the TLS handshake and the wait for the response
+	// headers once a request is sent, so a server that stalls is given up on. It does not limit
+	// the length of a download or an upload, which their duration does. Zero means no timeout
+	Timeout time.Duration
+	// SkipCertVerify disables verification of the servers' TLS certificates
+	SkipCertVerify bool
+	// SourceIP is the local address outgoing connections are bound to
+	SourceIP string
+	// Interface is the name of the network interface outgoing connections are bound to,
+	// its first usable address is used. It can not be combined with SourceIP
+	Interface string
+	// IPVersion restricts every connection to IPv4 (4) or IPv6 (6), zero allows both
+	IPVersion int
+	// Proxy is the URL of the proxy every request goes through, the environment's proxy settings
+	// (HTTP_PROXY, HTTPS_PROXY, NO_PROXY) are used when empty
+	Proxy string
+	// MaxConnsPerHost limits the number of connections per host, zero means no limit
+	MaxConnsPerHost int
+}
+
+// NewTransport builds an http.Transport from the given options
+func NewTransport(opts ClientOptions) (*http.Transport, error) {
+	dialer := &net.Dialer{
+		Timeout:   opts.Timeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	source, err := ResolveSourceIP(opts.SourceIP, opts.Interface, opts.IPVersion)
+	if err != nil {
+		return nil, err
+	}
+	if source != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(source)}
+	}
+
+	// "tcp" lets the resolver pick the address family, pin it down when asked to
+	dialContext := dialer.DialContext
+	if opts.IPVersion != 0 {
+		suffix := strconv.Itoa(opts.IPVersion)
+		dialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if network == "tcp" {
+				network += suffix
+			}
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if opts.Proxy != "" {
+		proxyURL, err := url.Parse(opts.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxConnsPerHost:       opts.MaxConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   opts.Timeout,
+		ResponseHeaderTimeout: opts.Timeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: opts.SkipCertVerify,
+		},
+	}, nil
+}
+
+// ResolveSourceIP validates the source address, or looks up the address of the network interface
+// to bind outgoing connections to. An empty string is returned when neither is given.
+// A non-zero ipVersion (4 or 6) restricts the address to that family
+func ResolveSourceIP(sourceIP string, iface string, ipVersion int) (string, error) {
+	if ipVersion != 0 && ipVersion != 4 && ipVersion != 6 {
+		return "", fmt.Errorf("invalid IP version: %d", ipVersion)
+	}
+	if sourceIP != "" && iface != "" {
+		return "", errors.New("a source IP address and a network interface can not be used together")
+	}
+
+	if sourceIP != "" {
+		ip := net.ParseIP(sourceIP)
+		if ip == nil {
+			return "", fmt.Errorf("invalid source IP address: %s", sourceIP)
+		}
+		if !matchesIPVersion(ip, ipVersion) {
+			return "", fmt.Errorf("source IP address %s is not an IPv%d address", sourceIP, ipVersion)
+		}
+		return ip.String(), nil
+	}
+
+	if iface == "" {
+		return "", nil
+	}
+
+	netIface, err := net.InterfaceByName(iface)
+	if err != nil {
+		return "", fmt.Errorf("unknown network interface %s: %w", iface, err)
+	}
+	addrs, err := netIface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("unable to get addresses of network interface %s: %w", iface, err)
+	}
+
+	// prefer the first IPv4 address, link-local addresses can't be used to reach the servers
+	var found net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() || !matchesIPVersion(ipNet.IP, ipVersion) {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP.String(), nil
+		}
+		if found == nil {
+			found = ipNet.IP
+		}
+	}
+	if found == nil {
+		if ipVersion != 0 {
+			return "", fmt.Errorf("network interface %s has no usable IPv%d address", iface, ipVersion)
+		}
+		return "", fmt.Errorf("network interface %s has no usable address", iface)
+	}
+	return found.String(), nil
+}
+
+// matchesIPVersion checks whether ip belongs to the given address family, zero matches both
+func matchesIPVersion(ip net.IP, ipVersion int) bool {
+	switch ipVersion {
+	case 4:
+		return ip.To4() != nil
+	case 6:
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
+// NewHTTPClient builds an http.Client from the given options, it can be handed to
+// Options.Client, FetchServerList, SendTelemetry or defs.Server.HTTPClient
+func NewHTTPClient(opts ClientOptions) (*http.Client, error) {
+	transport, err := NewTransport(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: transport}, nil
+}
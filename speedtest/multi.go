@@ -0,0 +1,76 @@
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/czechbol/librespeedtest/defs"
+	log "github.com/sirupsen/logrus"
+)
+
+// MultiSpeedTest runs the test against every given server, one after the other or all at once when
+// parallel is set. The reports are returned in the order of the servers, a server that fails is left
+// out and an error is only returned when all of them fail.
+// In parallel mode the events of all servers go to opts.Events at the same time
+func MultiSpeedTest(
+	ctx context.Context,
+	servers []defs.Server,
+	opts Options,
+	parallel bool,
+) ([]defs.Report, *defs.Summary, error) {
+	if len(servers) == 0 {
+		return nil, nil, errors.New("no server to test")
+	}
+
+	reports := make([]*defs.Report, len(servers))
+	errs := make([]error, len(servers))
+	test := func(i int) {
+		// every test gets its own copy, as Run sets up the server for the test
+		server := servers[i]
+		log.Infof("Starting the speed test against %s", server.Name)
+		if reports[i], errs[i] = Run(ctx, &server, opts); errs[i] != nil {
+			log.Warnf("Speed test against %s failed: %s", server.Name, errs[i])
+			errs[i] = fmt.Errorf("%s: %w", server.Name, errs[i])
+		}
+	}
+
+	if parallel {
+		var wg sync.WaitGroup
+		for i := range servers {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				test(i)
+			}(i)
+		}
+		wg.Wait()
+	} else {
+		for i := range servers {
+			if ctx.Err() != nil {
+				break
+			}
+			test(i)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var succeeded []defs.Report
+	for _, report := range reports {
+		if report != nil {
+			succeeded = append(succeeded, *report)
+		}
+	}
+	if len(succeeded) == 0 {
+		return nil, nil, errors.Join(errs...)
+	}
+
+	summary := defs.Summarize(succeeded)
+	summary.Failed = len(servers) - len(succeeded)
+	summary.Parallel = parallel
+	return succeeded, &summary, nil
+}
@@ -0,0 +1,336 @@
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/czechbol/librespeedtest/defs"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultRankProbes is the default number of latency probes sent to every server while ranking
+	DefaultRankProbes = 5
+	// DefaultRankWorkers is the default number of servers probed at the same time
+	DefaultRankWorkers = 16
+	// DefaultRankServerTimeout is the default time a single server may take to be probed
+	DefaultRankServerTimeout = 10 * time.Second
+	// DefaultRankTimeout is the default time the whole ranking may take
+	DefaultRankTimeout = 60 * time.Second
+	// rankLossPenalty is what losing every probe adds to the score, in milliseconds
+	rankLossPenalty = 1000
+)
+
+type PingJob struct {
+	Index  int
+	Server defs.Server
+}
+
+type PingResult struct {
+	Index int
+	Ping  float64
+	Probe *defs.ProbeResult
+}
+
+// RankOptions holds the parameters of the server ranking
+type RankOptions struct {
+	// Probes is the number of latency probes sent to every server, DefaultRankProbes is used when zero
+	Probes int
+	// ClientLocation is the client's location as "latitude,longitude". When set every server
+	// is located, which DistanceWeight, Nearest and Radius depend on
+	ClientLocation string
+	// DistanceWeight is what every 1000 km between the client and a server adds to its score,
+	// in milliseconds. Zero leaves the distance out
+	DistanceWeight float64
+	// Nearest only probes this many servers closest to the client, zero probes all of them
+	Nearest int
+	// Radius only probes the servers within this many kilometres of the client, zero probes all of them
+	Radius float64
+	// Workers is the number of servers probed at the same time, DefaultRankWorkers is used when zero
+	Workers int
+	// ServerTimeout limits the probing of a single server, DefaultRankServerTimeout is used when zero
+	ServerTimeout time.Duration
+	// Timeout limits the whole ranking, DefaultRankTimeout is used when zero. The servers that
+	// weren't probed in time are ranked as unreachable
+	Timeout time.Duration
+	// StopAfter ends the ranking once this many servers answered, zero probes all of them.
+	// The servers that weren't probed by then are ranked as unreachable
+	StopAfter int
+}
+
+// RankedServer represents a server with the measurements its rank is based on
+type RankedServer struct {
+	Server defs.Server
+	// Reachable is set when the server is up and answered at least one probe
+	Reachable bool
+	// Skipped is set when the server was left out by Nearest or Radius and never probed
+	Skipped bool
+	// Latency is the median round trip time and Jitter its jitter, in milliseconds
+	Latency float64
+	Jitter  float64
+	// Loss is the share of the probes that weren't answered, from 0 to 1
+	Loss float64
+	// Distance is the distance from the client in kilometres, only valid when Located is set
+	Distance float64
+	Located  bool
+	// Score is the median latency with the jitter, the loss and the distance penalties added,
+	// lower is better
+	Score float64
+}
+
+// RankServer performs a ping request to each server frin the given slice and
+// returns the fastest one
+func RankServers(ctx context.Context, servers *[]defs.Server) (defs.Server, error) {
+	ranked, err := RankTopServers(ctx, servers, 1)
+	if err != nil {
+		return defs.Server{}, err
+	}
+	return ranked[0], nil
+}
+
+// RankTopServers ranks the servers with the default options and returns up to n of the reachable ones,
+// best first
+func RankTopServers(ctx context.Context, servers *[]defs.Server, n int) ([]defs.Server, error) {
+	ranked, err := Rank(ctx, *servers, RankOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return TopServers(ranked, n)
+}
+
+// TopServers returns up to n of the reachable ranked servers, it is an error when none is reachable
+func TopServers(ranked []RankedServer, n int) ([]defs.Server, error) {
+	var top []defs.Server
+	for _, r := range ranked {
+		if r.Reachable && (n <= 0 || len(top) < n) {
+			top = append(top, r.Server)
+		}
+	}
+	if len(top) == 0 {
+		return nil, errors.New(
+			"No server is currently available, please try again later.",
+		)
+	}
+	return top, nil
+}
+
+// Rank probes every server and returns all of them ordered by score, the unreachable ones last.
+// When opts.ClientLocation is set the servers are located first and only the ones passing
+// opts.Nearest and opts.Radius are probed. Every goroutine it starts has finished when it returns
+func Rank(ctx context.Context, servers []defs.Server, opts RankOptions) ([]RankedServer, error) {
+	if opts.Probes <= 0 {
+		opts.Probes = DefaultRankProbes
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultRankWorkers
+	}
+	if opts.ServerTimeout <= 0 {
+		opts.ServerTimeout = DefaultRankServerTimeout
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultRankTimeout
+	}
+
+	rankCtx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	ranked := make([]RankedServer, len(servers))
+	for idx, server := range servers {
+		ranked[idx] = RankedServer{Server: server}
+	}
+	if opts.ClientLocation != "" {
+		locateServers(rankCtx, ranked, opts)
+		if opts.Nearest > 0 || opts.Radius > 0 {
+			preselect(ranked, opts)
+		}
+	}
+
+	var wg sync.WaitGroup
+	jobs := make(chan PingJob, len(servers))
+	// the results never block a worker, so the workers always get to finish
+	results := make(chan PingResult, len(servers))
+
+	// spawn a bounded pool of pingers
+	for i := 0; i < opts.Workers && i < len(servers); i++ {
+		wg.Add(1)
+		go pingWorker(rankCtx, opts, jobs, results, &wg)
+	}
+	// send ping jobs to workers
+	for idx, r := range ranked {
+		if !r.Skipped {
+			jobs <- PingJob{Index: idx, Server: r.Server}
+		}
+	}
+	close(jobs)
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	pingList := make(map[int]PingResult)
+	for result := range results {
+		pingList[result.Index] = result
+		if opts.StopAfter > 0 && len(pingList) == opts.StopAfter {
+			log.Debugf("Ranking: %d servers answered, skipping the rest", len(pingList))
+			cancel()
+		}
+	}
+
+	// running out of the ranking's own time isn't an error, the caller's context being done is
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if rankCtx.Err() == context.DeadlineExceeded {
+		log.Warnf("Ranking the servers took longer than %s, not all of them were probed", opts.Timeout)
+	}
+
+	for idx, result := range pingList {
+		r := &ranked[idx]
+		r.Reachable = true
+		r.Latency = result.Probe.Median()
+		r.Jitter = result.Probe.Jitter()
+		r.Loss = result.Probe.Loss()
+		r.Score = r.Latency + r.Jitter + r.Loss*rankLossPenalty
+		if r.Located {
+			r.Score += opts.DistanceWeight * r.Distance / 1000
+		}
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].Reachable != ranked[j].Reachable {
+			return ranked[i].Reachable
+		}
+		if ranked[i].Skipped != ranked[j].Skipped {
+			return !ranked[i].Skipped
+		}
+		return ranked[i].Score < ranked[j].Score
+	})
+	return ranked, nil
+}
+
+// locateServers fills in the distance of every ranked server from opts.ClientLocation, using the
+// location from the server list or looking the server's address up. Up to opts.Workers servers are
+// located at the same time, each within opts.ServerTimeout
+func locateServers(ctx context.Context, ranked []RankedServer, opts RankOptions) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, opts.Workers)
+	for idx := range ranked {
+		wg.Add(1)
+		go func(r *RankedServer) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			if ctx.Err() != nil {
+				return
+			}
+
+			serverCtx, cancel := context.WithTimeout(ctx, opts.ServerTimeout)
+			defer cancel()
+			location, err := r.Server.Locate(serverCtx)
+			if err != nil || location == "" {
+				log.Debugf("Can't locate server %s, its distance is unknown", r.Server.Name)
+				return
+			}
+			if r.Distance, err = defs.DistanceKm(opts.ClientLocation, location); err == nil {
+				r.Located = true
+			}
+		}(&ranked[idx])
+	}
+	wg.Wait()
+}
+
+// preselect marks the servers beyond opts.Radius or past the opts.Nearest closest ones as skipped.
+// The servers that couldn't be located are skipped too, unless none could be
+func preselect(ranked []RankedServer, opts RankOptions) {
+	var located []*RankedServer
+	for idx := range ranked {
+		if ranked[idx].Located {
+			located = append(located, &ranked[idx])
+		}
+	}
+	if len(located) == 0 {
+		log.Warn("None of the servers could be located, probing all of them")
+		return
+	}
+
+	sort.SliceStable(located, func(i, j int) bool {
+		return located[i].Distance < located[j].Distance
+	})
+	selected := make(map[*RankedServer]bool)
+	for i, r := range located {
+		if opts.Nearest > 0 && i >= opts.Nearest {
+			break
+		}
+		if opts.Radius > 0 && r.Distance > opts.Radius {
+			break
+		}
+		selected[r] = true
+	}
+	if len(selected) == 0 {
+		log.Warnf("None of the servers is within %.0f km", opts.Radius)
+	}
+	for idx := range ranked {
+		ranked[idx].Skipped = !selected[&ranked[idx]]
+	}
+	log.Debugf("Ranking: probing the %d nearest of %d servers", len(selected), len(ranked))
+}
+
+// pingWorker probes the servers from jobs until the channel is closed, sending the reachable ones
+// to results. Once ctx is done the remaining jobs are skipped
+func pingWorker(
+	ctx context.Context,
+	opts RankOptions,
+	jobs <-chan PingJob,
+	results chan<- PingResult,
+	wg *sync.WaitGroup,
+) {
+	defer wg.Done()
+	for job := range jobs {
+		if ctx.Err() != nil {
+			continue
+		}
+		if result, ok := probeServer(ctx, opts, job); ok {
+			results <- result
+		}
+	}
+}
+
+// probeServer checks the server is up and probes its latency within opts.ServerTimeout
+func probeServer(ctx context.Context, opts RankOptions, job PingJob) (PingResult, bool) {
+	ctx, cancel := context.WithTimeout(ctx, opts.ServerTimeout)
+	defer cancel()
+
+	server := job.Server
+	// get the URL of the speed test server from the JSON
+	u, err := server.GetURL()
+	if err != nil {
+		log.Debugf(
+			"Server URL is invalid for %s (%s), skipping",
+			server.Name,
+			server.Server,
+		)
+		return PingResult{}, false
+	}
+
+	// check the server is up by accessing the ping URL and checking its returned value == empty and status code == 200
+	if !server.IsUp(ctx) {
+		log.Debugf("Server %s (%s) doesn't seem to be up, skipping", server.Name, u.Hostname())
+		return PingResult{}, false
+	}
+
+	// if server is up, probe its latency
+	probe, err := server.Probe(ctx, opts.Probes)
+	if err != nil || len(probe.Pings) == 0 {
+		log.Debugf(
+			"Can't ping server %s (%s), skipping",
+			server.Name,
+			u.Hostname(),
+		)
+		return PingResult{}, false
+	}
+	return PingResult{Index: job.Index, Ping: probe.Median(), Probe: probe}, true
+}
@@ -0,0 +1,193 @@
+package speedtest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/czechbol/librespeedtest/defs"
+)
+
+// newPingServer starts a test server whose ping URL answers after delay with the given status
+func newPingServer(t *testing.T, id int, delay time.Duration, status int) defs.Server {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(ts.Close)
+	return defs.Server{ID: id, Name: ts.URL, Server: ts.URL, PingURL: "empty.php", NoICMP: true}
+}
+
+func TestRankOrder(t *testing.T) {
+	servers := []defs.Server{
+		newPingServer(t, 1, 40*time.Millisecond, http.StatusOK),
+		newPingServer(t, 2, 0, http.StatusInternalServerError),
+		newPingServer(t, 3, 0, http.StatusOK),
+	}
+
+	ranked, err := Rank(context.Background(), servers, RankOptions{Probes: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []int
+	for _, r := range ranked {
+		order = append(order, r.Server.ID)
+	}
+	if want := []int{3, 1, 2}; !equalInts(order, want) {
+		t.Fatalf("ranked %v, want %v", order, want)
+	}
+
+	for _, r := range ranked[:2] {
+		if !r.Reachable {
+			t.Errorf("server %d is not reachable", r.Server.ID)
+		}
+		if want := r.Latency + r.Jitter + r.Loss*rankLossPenalty; r.Score != want {
+			t.Errorf("server %d scored %f, want %f", r.Server.ID, r.Score, want)
+		}
+	}
+	if ranked[1].Latency < 40 {
+		t.Errorf("slow server latency is %f ms, want at least 40 ms", ranked[1].Latency)
+	}
+	if ranked[2].Reachable {
+		t.Error("the failing server is reachable")
+	}
+
+	top, err := TopServers(ranked, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 1 || top[0].ID != 3 {
+		t.Errorf("top server is %v, want server 3", top)
+	}
+}
+
+func TestRankStopAfter(t *testing.T) {
+	servers := []defs.Server{
+		newPingServer(t, 1, 0, http.StatusOK),
+		newPingServer(t, 2, 0, http.StatusOK),
+		newPingServer(t, 3, 0, http.StatusOK),
+	}
+
+	ranked, err := Rank(context.Background(), servers, RankOptions{Probes: 1, Workers: 1, StopAfter: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reachable int
+	for _, r := range ranked {
+		if r.Reachable {
+			reachable++
+		}
+	}
+	if reachable != 1 {
+		t.Errorf("%d servers were ranked as reachable, want 1", reachable)
+	}
+	if !ranked[0].Reachable {
+		t.Error("the answering server isn't ranked first")
+	}
+}
+
+func TestRankUnreachable(t *testing.T) {
+	servers := []defs.Server{newPingServer(t, 1, 0, http.StatusNotFound)}
+
+	ranked, err := Rank(context.Background(), servers, RankOptions{Probes: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TopServers(ranked, 1); err == nil {
+		t.Error("TopServers returned no error without a reachable server")
+	}
+}
+
+func TestPreselect(t *testing.T) {
+	// the servers are 222, 10 and 111 km away, the third one couldn't be located
+	located := func(id int, km float64) RankedServer {
+		return RankedServer{Server: defs.Server{ID: id}, Distance: km, Located: true}
+	}
+	servers := func() []RankedServer {
+		return []RankedServer{
+			located(1, 222),
+			located(2, 10),
+			{Server: defs.Server{ID: 3}},
+			located(4, 111),
+		}
+	}
+
+	tests := []struct {
+		name     string
+		opts     RankOptions
+		selected []int
+	}{
+		{"nearest", RankOptions{Nearest: 2}, []int{2, 4}},
+		{"radius", RankOptions{Radius: 150}, []int{2, 4}},
+		{"nearest within radius", RankOptions{Nearest: 1, Radius: 150}, []int{2}},
+		{"radius beyond all", RankOptions{Radius: 1000}, []int{1, 2, 4}},
+		{"none within radius", RankOptions{Radius: 5}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranked := servers()
+			preselect(ranked, tt.opts)
+			var selected []int
+			for _, r := range ranked {
+				if !r.Skipped {
+					selected = append(selected, r.Server.ID)
+				}
+			}
+			if !equalInts(selected, tt.selected) {
+				t.Errorf("selected %v, want %v", selected, tt.selected)
+			}
+		})
+	}
+
+	t.Run("none located", func(t *testing.T) {
+		ranked := []RankedServer{{Server: defs.Server{ID: 1}}, {Server: defs.Server{ID: 2}}}
+		preselect(ranked, RankOptions{Nearest: 1})
+		for _, r := range ranked {
+			if r.Skipped {
+				t.Errorf("server %d was skipped", r.Server.ID)
+			}
+		}
+	})
+}
+
+func TestRankDistanceWeight(t *testing.T) {
+	near := newPingServer(t, 1, 20*time.Millisecond, http.StatusOK)
+	near.Location = "50.0,14.0"
+	far := newPingServer(t, 2, 0, http.StatusOK)
+	far.Location = "50.0,-100.0"
+
+	ranked, err := Rank(context.Background(), []defs.Server{far, near}, RankOptions{
+		Probes:         2,
+		ClientLocation: "50.0,14.0",
+		DistanceWeight: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ranked[0].Server.ID != 1 {
+		t.Errorf("ranked server %d first, want the nearby one", ranked[0].Server.ID)
+	}
+	for _, r := range ranked {
+		if !r.Located {
+			t.Errorf("server %d wasn't located", r.Server.ID)
+		}
+	}
+	if ranked[0].Distance != 0 {
+		t.Errorf("nearby server is %f km away, want 0", ranked[0].Distance)
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,480 @@
+package speedtest
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptrace"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/czechbol/librespeedtest/defs"
+	log "github.com/sirupsen/logrus"
+)
+
+// The responsiveness test follows draft-ietf-ippm-responsiveness: load-generating connections
+// are added until the aggregate throughput stops growing, then the latency of fresh connections
+// ("foreign" probes) and of the load-generating connections ("self" probes) is measured under that load.
+const (
+	// rpmInterval is how often the throughput is evaluated and connections are added
+	rpmInterval = time.Second
+	// rpmStableCount is the number of consecutive moving averages that have to agree for saturation
+	rpmStableCount = 4
+	// rpmStableTolerance is the relative spread allowed between the agreeing moving averages
+	rpmStableTolerance = 0.05
+	// rpmConnectionStep is the number of load-generating connections added per direction and interval
+	rpmConnectionStep = 4
+	// rpmProbeInterval is the interval between two probes of the same kind
+	rpmProbeInterval = 100 * time.Millisecond
+	// rpmProbeDuration is how long the latency is probed once the connection is saturated
+	rpmProbeDuration = 2 * time.Second
+	// rpmTrimPercentile is the share of the slowest probes left out of the trimmed mean
+	rpmTrimPercentile = 0.05
+)
+
+// ResponsivenessOptions holds the parameters of the responsiveness test
+type ResponsivenessOptions struct {
+	// NoDownload and NoUpload leave a direction out of the load
+	NoDownload bool
+	NoUpload   bool
+	// Chunks is the number of chunks requested per download request
+	Chunks int
+	// UploadSize is the size of the upload payload in KiB
+	UploadSize int
+	// MaxDuration limits the ramp-up of the load, DefaultResponsivenessDuration is used when zero
+	MaxDuration time.Duration
+	// MaxConnections limits the load-generating connections per direction,
+	// DefaultResponsivenessConnections is used when zero
+	MaxConnections int
+}
+
+const (
+	DefaultResponsivenessDuration    = 20 * time.Second
+	DefaultResponsivenessConnections = 16
+)
+
+// MeasureResponsiveness loads the connection to the server until it is saturated and
+// measures its responsiveness in round trips per minute
+func MeasureResponsiveness(
+	ctx context.Context,
+	server *defs.Server,
+	opts ResponsivenessOptions,
+) (*defs.Responsiveness, error) {
+	if opts.NoDownload && opts.NoUpload {
+		return nil, errors.New("responsiveness needs at least one direction to load the connection")
+	}
+	if opts.MaxDuration <= 0 {
+		opts.MaxDuration = DefaultResponsivenessDuration
+	}
+	if opts.MaxConnections <= 0 {
+		opts.MaxConnections = DefaultResponsivenessConnections
+	}
+
+	t := time.Now()
+	defer func() {
+		server.TLog.Logf("Responsiveness test took %s", time.Now().Sub(t).String())
+	}()
+
+	u, err := server.GetURL()
+	if err != nil {
+		return nil, err
+	}
+	downloadURL, uploadURL, pingURL := *u, *u, *u
+	downloadURL.Path = path.Join(u.Path, server.DownloadURL)
+	q := downloadURL.Query()
+	q.Set("ckSize", strconv.Itoa(opts.Chunks))
+	downloadURL.RawQuery = q.Encode()
+	uploadURL.Path = path.Join(u.Path, server.UploadURL)
+	pingURL.Path = path.Join(u.Path, server.PingURL)
+
+	loadCtx, stopLoad := context.WithCancel(ctx)
+	// every load-generating request needs its own TCP connection, so HTTP/2 is kept out of the way
+	loadTransport := http1Transport(server)
+	loadClient := &http.Client{Transport: loadTransport}
+	load := &rpmLoad{}
+	var loadWg sync.WaitGroup
+	defer func() {
+		stopLoad()
+		loadWg.Wait()
+		loadTransport.CloseIdleConnections()
+	}()
+
+	addConnections := func() {
+		for i := 0; i < rpmConnectionStep; i++ {
+			if !opts.NoDownload {
+				loadWg.Add(1)
+				go func() {
+					defer loadWg.Done()
+					load.download(loadCtx, loadClient, downloadURL.String())
+				}()
+			}
+			if !opts.NoUpload {
+				loadWg.Add(1)
+				go func() {
+					defer loadWg.Done()
+					load.upload(loadCtx, loadClient, uploadURL.String(), opts.UploadSize)
+				}()
+			}
+		}
+	}
+
+	result := defs.Responsiveness{}
+	addConnections()
+	connections := rpmConnectionStep
+
+	// ramp up until the moving average of the throughput is stable
+	deadline := time.After(opts.MaxDuration)
+	ticker := time.NewTicker(rpmInterval)
+	defer ticker.Stop()
+	var lastTotal int
+	var instant, averages []float64
+Ramp:
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-deadline:
+			log.Debug("Responsiveness: connection not saturated before the deadline")
+			break Ramp
+		case <-ticker.C:
+		}
+
+		total := load.total()
+		instant = append(instant, float64(total-lastTotal)/rpmInterval.Seconds())
+		lastTotal = total
+		averages = append(averages, getAverage(lastValues(instant, rpmStableCount)))
+		server.Emit(defs.Event{
+			Type:  defs.EventThroughputSample,
+			Phase: defs.PhaseResponsiveness,
+			Bytes: total,
+			Speed: averages[len(averages)-1],
+		})
+
+		if len(averages) >= rpmStableCount && isStable(lastValues(averages, rpmStableCount)) {
+			result.Saturated = true
+			break Ramp
+		}
+		if connections < opts.MaxConnections {
+			addConnections()
+			connections += rpmConnectionStep
+		}
+	}
+
+	// measure the latency while the load keeps running, the throughput is reported for this phase only
+	saturated := time.Now()
+	dlStart, ulStart := load.bytes()
+	probeCtx, stopProbes := context.WithTimeout(ctx, rpmProbeDuration)
+	defer stopProbes()
+
+	var wg sync.WaitGroup
+	var foreign []rpmProbe
+	var self []float64
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		foreign = foreignProbes(probeCtx, server, pingURL.String())
+	}()
+	go func() {
+		defer wg.Done()
+		self = selfProbes(probeCtx, loadClient, pingURL.String())
+	}()
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	dlBytes, ulBytes := load.bytes()
+	dlBytes, ulBytes = dlBytes-dlStart, ulBytes-ulStart
+	elapsed := time.Since(saturated).Seconds()
+	stopLoad()
+
+	if len(foreign) == 0 && len(self) == 0 {
+		return nil, errors.New("no responsiveness probe succeeded")
+	}
+
+	var tcp, tlsHandshake, httpForeign []float64
+	for _, probe := range foreign {
+		tcp = append(tcp, probe.tcp)
+		if probe.secure {
+			tlsHandshake = append(tlsHandshake, probe.tls)
+		}
+		httpForeign = append(httpForeign, probe.http)
+	}
+	result.TCPHandshake = trimmedMean(tcp)
+	result.TLSHandshake = trimmedMean(tlsHandshake)
+	result.HTTPLatency = trimmedMean(httpForeign)
+	result.InConnectionLatency = trimmedMean(self)
+	result.Connections = connections
+	result.DownloadMbps = float64(dlBytes) * 8 / elapsed / 1000 / 1000
+	result.UploadMbps = float64(ulBytes) * 8 / elapsed / 1000 / 1000
+
+	// RPM = 60000 / (1/6 TM(tcp_f) + 1/6 TM(tls_f) + 1/6 TM(http_f) + 1/2 TM(http_s)),
+	// without a TLS handshake on plain HTTP the foreign half is split between tcp_f and http_f
+	foreignLatency := []float64{result.TCPHandshake, result.HTTPLatency}
+	if len(tlsHandshake) > 0 {
+		foreignLatency = append(foreignLatency, result.TLSHandshake)
+	}
+	var roundTrip float64
+	switch {
+	case len(foreign) == 0:
+		roundTrip = result.InConnectionLatency
+	case len(self) == 0:
+		roundTrip = getAverage(foreignLatency)
+	default:
+		roundTrip = getAverage(foreignLatency)/2 + result.InConnectionLatency/2
+	}
+	if roundTrip > 0 {
+		result.RPM = math.Round(60000 / roundTrip)
+	}
+	result.Rating = defs.ResponsivenessRating(result.RPM)
+
+	return &result, nil
+}
+
+// rpmLoad keeps track of the bytes transferred by the load-generating connections
+type rpmLoad struct {
+	lock      sync.Mutex
+	downloads []*defs.BytesCounter
+	uploads   []*defs.BytesCounter
+}
+
+// download keeps downloading from url until ctx is done
+func (l *rpmLoad) download(ctx context.Context, client *http.Client, url string) {
+	counter := defs.NewCounter()
+	l.lock.Lock()
+	l.downloads = append(l.downloads, counter)
+	l.lock.Unlock()
+
+	for ctx.Err() == nil {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return
+		}
+		req.Header.Set("User-Agent", defs.UserAgent)
+		req.Header.Set("Accept-Encoding", "identity")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Debugf("Responsiveness: download failed: %s", err)
+			}
+			return
+		}
+		io.Copy(counter, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// upload keeps uploading to url until ctx is done
+func (l *rpmLoad) upload(ctx context.Context, client *http.Client, url string, uploadSize int) {
+	counter := defs.NewCounter()
+	counter.SetUploadSize(uploadSize)
+	counter.GenerateBlob()
+	l.lock.Lock()
+	l.uploads = append(l.uploads, counter)
+	l.lock.Unlock()
+
+	for ctx.Err() == nil {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, counter)
+		if err != nil {
+			return
+		}
+		req.Header.Set("User-Agent", defs.UserAgent)
+		req.Header.Set("Accept-Encoding", "identity")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Debugf("Responsiveness: upload failed: %s", err)
+			}
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// bytes returns the bytes downloaded and uploaded so far
+func (l *rpmLoad) bytes() (int, int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var downloaded, uploaded int
+	for _, c := range l.downloads {
+		downloaded += c.Total()
+	}
+	for _, c := range l.uploads {
+		uploaded += c.Total()
+	}
+	return downloaded, uploaded
+}
+
+// total returns the bytes transferred in both directions so far
+func (l *rpmLoad) total() int {
+	downloaded, uploaded := l.bytes()
+	return downloaded + uploaded
+}
+
+// rpmProbe holds the timings of a probe on a fresh connection, in milliseconds
+type rpmProbe struct {
+	tcp  float64
+	tls  float64
+	http float64
+	// secure tells whether the probe made a TLS handshake
+	secure bool
+}
+
+// foreignProbes requests url over a new connection every rpmProbeInterval until ctx is done
+func foreignProbes(ctx context.Context, server *defs.Server, url string) []rpmProbe {
+	transport := http1Transport(server)
+	transport.DisableKeepAlives = true
+	client := &http.Client{Transport: transport}
+
+	var probes []rpmProbe
+	ticker := time.NewTicker(rpmProbeInterval)
+	defer ticker.Stop()
+	for {
+		var probe rpmProbe
+		var connectStart, tlsStart, requestWritten time.Time
+		trace := &httptrace.ClientTrace{
+			ConnectStart: func(string, string) { connectStart = time.Now() },
+			ConnectDone: func(string, string, error) {
+				probe.tcp = milliseconds(time.Since(connectStart))
+			},
+			TLSHandshakeStart: func() { tlsStart = time.Now() },
+			TLSHandshakeDone: func(tls.ConnectionState, error) {
+				probe.tls = milliseconds(time.Since(tlsStart))
+				probe.secure = true
+			},
+			WroteRequest: func(httptrace.WroteRequestInfo) { requestWritten = time.Now() },
+			GotFirstResponseByte: func() {
+				probe.http = milliseconds(time.Since(requestWritten))
+			},
+		}
+		if err := probeOnce(httptrace.WithClientTrace(ctx, trace), client, url); err == nil {
+			probes = append(probes, probe)
+		}
+
+		select {
+		case <-ctx.Done():
+			return probes
+		case <-ticker.C:
+		}
+	}
+}
+
+// selfProbes requests url every rpmProbeInterval until ctx is done, over the client of the load-generating
+// connections. Over HTTP/1 a connection carries one request at a time, so a probe takes one of the load
+// connections as it finishes a transfer, with the congestion state and socket buffers the load built up
+func selfProbes(ctx context.Context, client *http.Client, url string) []float64 {
+	// the first request may set up a connection and isn't measured
+	if err := probeOnce(ctx, client, url); err != nil {
+		return nil
+	}
+
+	var probes []float64
+	ticker := time.NewTicker(rpmProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return probes
+		case <-ticker.C:
+		}
+
+		start := time.Now()
+		if err := probeOnce(ctx, client, url); err == nil {
+			probes = append(probes, milliseconds(time.Since(start)))
+		}
+	}
+}
+
+// probeOnce requests url and reads the whole response
+func probeOnce(ctx context.Context, client *http.Client, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", defs.UserAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Debugf("Responsiveness: probe failed: %s", err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	return err
+}
+
+// http1Transport returns a copy of the server's HTTP transport that doesn't negotiate HTTP/2
+func http1Transport(server *defs.Server) *http.Transport {
+	var transport *http.Transport
+	if t, ok := server.GetHTTPClient().Transport.(*http.Transport); ok {
+		transport = t.Clone()
+	} else if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		log.Debug("Responsiveness: custom round tripper can't be cloned, using the default transport")
+		transport = t.Clone()
+	} else {
+		transport = &http.Transport{Proxy: http.ProxyFromEnvironment}
+	}
+
+	transport.ForceAttemptHTTP2 = false
+	transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	return transport
+}
+
+// isStable checks whether the values are within rpmStableTolerance of each other
+func isStable(values []float64) bool {
+	min, max := values[0], values[0]
+	for _, v := range values {
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+	}
+	return max > 0 && (max-min)/max <= rpmStableTolerance
+}
+
+// trimmedMean returns the mean of the values without the slowest rpmTrimPercentile of them
+func trimmedMean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	keep := len(sorted) - int(float64(len(sorted))*rpmTrimPercentile)
+	return getAverage(sorted[:keep])
+}
+
+// lastValues returns up to n last values of the slice
+func lastValues(values []float64, n int) []float64 {
+	if len(values) <= n {
+		return values
+	}
+	return values[len(values)-n:]
+}
+
+// getAverage returns the average value of a float64 slice
+func getAverage(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	var total float64
+	for _, v := range values {
+		total += v
+	}
+	return total / float64(len(values))
+}
+
+// milliseconds converts a duration to fractional milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -2,7 +2,9 @@ package speedtest
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"mime/multipart"
@@ -15,10 +17,97 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// Options holds the parameters of a single speed test run
+type Options struct {
+	// NoDownload skips the download test
+	NoDownload bool
+	// NoUpload skips the upload test
+	NoUpload bool
+	// PingCount is the number of pings used for the ping and jitter test
+	PingCount int
+	// DistanceUnit should be one of ["mi", "km", "NM"] (miles, kilometers, nautical miles)
+	DistanceUnit string
+	// Requests is the number of concurrent HTTP requests made during download and upload
+	Requests int
+	// Chunks is the number of chunks requested from the server per download request
+	Chunks int
+	// NoPrealloc disables pre-allocation of the upload payload
+	NoPrealloc bool
+	// UploadSize is the size of the upload payload in KiB
+	UploadSize int
+	// Duration is the length of both the download and the upload test, or their maximum length
+	// when EarlyStop is set
+	Duration time.Duration
+	// Bidirectional runs the download and the upload at the same time after the upload test,
+	// it runs even when both NoDownload and NoUpload are set
+	Bidirectional bool
+	// AutoTune picks the number of requests, the chunk count and the upload payload size by probing
+	// the link before the download, Requests, Chunks and UploadSize are only used for the probes
+	AutoTune bool
+	// EarlyStop ends the download and the upload as soon as their throughput is stable
+	EarlyStop *defs.EarlyStop
+	// LatencyInterval is the interval between latency probes sent during the download and the upload,
+	// zero disables measuring the loaded latency
+	LatencyInterval time.Duration
+	// Warmup is the time at the start of the download and the upload whose bytes are left out of the speed
+	Warmup time.Duration
+	// Aggregation is the method used to calculate the download and upload speed from the throughput
+	// samples, defs.AggregationMean is used when empty
+	Aggregation defs.Aggregation
+	// SampleInterval is the interval between the throughput samples recorded in the report,
+	// defs.DefaultSampleInterval is used when zero
+	SampleInterval time.Duration
+	// Responsiveness runs the responsiveness (RPM) test after the upload test
+	Responsiveness bool
+	// NoShare disables sending the results to the telemetry server
+	NoShare bool
+	// Telemetry is the telemetry server the results are shared with, its empty fields
+	// are filled in from the DefaultTelemetry constants
+	Telemetry defs.TelemetryServer
+	// TelemetryExtra is sent in the extra field of the telemetry data
+	TelemetryExtra string
+	// IPInfoFallback looks the client up on ipinfo.io when the backend's getIP endpoint fails,
+	// otherwise the test goes on without the client's info
+	IPInfoFallback bool
+	// Privacy skips every geolocation lookup, redacts the client's details in the report and only
+	// shares the throughput with the telemetry server
+	Privacy bool
+	// Geo locates the client and the server instead of ipinfo.io, the client's ISP info from
+	// the getIP endpoint is completed by it when set
+	Geo defs.GeoProvider
+	// Events receives the progress of the test, it is left unset on the server when nil
+	Events defs.EventHandler
+	// EventInterval is the interval between throughput samples, defs.DefaultEventInterval is used when zero
+	EventInterval time.Duration
+	// Client is used for every HTTP request of the test, it is left unset on the server when nil
+	// and ClientOptions is empty
+	Client *http.Client
+	// ClientOptions describes how the connections of the test are made. When Client is nil and
+	// ClientOptions is not empty, a client is built from it. Its SourceIP, Interface and IPVersion
+	// are applied to ICMP pings and recorded in the report in either case
+	ClientOptions ClientOptions
+	// DualStack runs the whole test twice, once over IPv4 and once over IPv6, and reports both
+	// results side by side. It builds a client per address family from ClientOptions, Client is ignored
+	DualStack bool
+}
+
+// DefaultOptions returns the options used by AutoSpeedTest
+func DefaultOptions() Options {
+	return Options{
+		PingCount:    DefaultPingCount,
+		DistanceUnit: "km",
+		Requests:     3,
+		Chunks:       100,
+		UploadSize:   1024,
+		Duration:     time.Duration(15) * time.Second,
+	}
+}
+
 // AutoSpeedTest is a function that selects the fastest server
 // and runs a fully automatic speedtest with default parameters,
 // distanceUnit shoulr be one of ["mi", "km", "NM"] (miles, kilometers, nautical miles)
 func AutoSpeedTest(
+	ctx context.Context,
 	distanceUnit string,
 	forceHTTPS bool,
 	noICMP bool,
@@ -27,32 +116,26 @@ func AutoSpeedTest(
 	var serverList *[]defs.Server
 	var testServer defs.Server
 	var err error
-	if serverList, err = FetchServerList(ServerListUrl); err != nil {
+	if serverList, err = fetchServerList(ctx, nil, ServerListUrl, ParseServerListSkipInvalid); err != nil {
 		return nil, err
 	}
 	if err = PreprocessServers(serverList, forceHTTPS, noICMP); err != nil {
 		return nil, err
 	}
-	if testServer, err = RankServers(serverList); err != nil {
+	if testServer, err = RankServers(ctx, serverList); err != nil {
 		return nil, err
 	}
-	return SingleSpeedTest(
-		&testServer,
-		false,
-		false,
-		DefaultPingCount,
-		distanceUnit,
-		3,
-		100,
-		false,
-		1024,
-		time.Duration(15)*time.Second,
-		noShare,
-	)
+
+	opts := DefaultOptions()
+	opts.DistanceUnit = distanceUnit
+	opts.NoShare = noShare
+	return Run(ctx, &testServer, opts)
 }
 
 // SingleSpeedTest runs a speedtest for one server and returns a corresponding Report object
 // distanceUnit shoulr be one of ["mi", "km", "NM"] (miles, kilometers, nautical miles)
+//
+// Deprecated: use Run, which can be cancelled through its context.
 func SingleSpeedTest(
 	server *defs.Server,
 	noDownload bool,
@@ -66,46 +149,225 @@ func SingleSpeedTest(
 	duration time.Duration,
 	noShare bool,
 ) (*defs.Report, error) {
-	report := defs.Report{Server: *server}
+	return Run(context.Background(), server, Options{
+		NoDownload:   noDownload,
+		NoUpload:     noUpload,
+		PingCount:    pingCount,
+		DistanceUnit: distanceUnit,
+		Requests:     requests,
+		Chunks:       chunks,
+		NoPrealloc:   noPrealloc,
+		UploadSize:   uploadSize,
+		Duration:     duration,
+		NoShare:      noShare,
+	})
+}
 
-	log.Info("Getting ISP information")
-	ispInfo, err := server.WorkaroundGetIPInfo(distanceUnit)
+// Run runs a speedtest for one server and returns a corresponding Report object.
+// Every phase of the test is bound to ctx and stops as soon as it is cancelled.
+func Run(ctx context.Context, server *defs.Server, opts Options) (*defs.Report, error) {
+	if opts.DualStack {
+		return runDualStack(ctx, server, opts)
+	}
+
+	if opts.Events != nil {
+		server.Events = opts.Events
+		server.EventInterval = opts.EventInterval
+	}
+	source, err := ResolveSourceIP(
+		opts.ClientOptions.SourceIP,
+		opts.ClientOptions.Interface,
+		opts.ClientOptions.IPVersion,
+	)
 	if err != nil {
-		log.Errorf("Failed to get IP info: %s", err)
 		return nil, err
 	}
-	report.Client = defs.Client{IPInfoResponse: ispInfo.RawISPInfo}
+	server.SourceIP = source
+	server.IPVersion = opts.ClientOptions.IPVersion
+	if opts.Client != nil {
+		server.HTTPClient = opts.Client
+	} else if opts.ClientOptions != (ClientOptions{}) {
+		if server.HTTPClient, err = NewHTTPClient(opts.ClientOptions); err != nil {
+			return nil, err
+		}
+	}
+	telemetryServer := opts.telemetryServer()
+	server.TLog = defs.NewTelemetryLog(telemetryServer.GetLevel())
+	server.TLog.Verbosef(
+		"Test options: requests %d, chunks %d, upload size %d, duration %s",
+		opts.Requests,
+		opts.Chunks,
+		opts.UploadSize,
+		opts.Duration,
+	)
+	report := defs.Report{Server: *server, IPVersion: server.IPVersion}
+
+	log.Info("Getting ISP information")
+	var ispInfo *defs.GetIPResult
+	if opts.Privacy {
+		ispInfo, err = server.GetIP(ctx)
+	} else {
+		ispInfo, err = server.GetIPInfo(ctx, opts.DistanceUnit)
+	}
+	if err != nil && opts.IPInfoFallback && !opts.Privacy {
+		log.Warnf("Failed to get IP info from the server, falling back to ipinfo.io: %s", err)
+		ispInfo, err = server.WorkaroundGetIPInfo(ctx, opts.DistanceUnit)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// the client's info is only reported, the test doesn't need it
+		log.Warnf("Failed to get IP info, going on without it: %s", err)
+		ispInfo = &defs.GetIPResult{}
+	}
+	if opts.Geo != nil && !opts.Privacy {
+		server.Geo = opts.Geo
+		// the getIP endpoint already answered for the backend provider
+		if _, backend := opts.Geo.(*defs.BackendProvider); !backend {
+			if geoInfo, err := server.LookupIPInfo(ctx, ispInfo.RawISPInfo, opts.DistanceUnit); err != nil {
+				log.Warnf("Failed to locate you: %s", err)
+			} else {
+				ispInfo = geoInfo
+			}
+		}
+	}
+	report.Client = defs.Client{
+		IPInfoResponse: ispInfo.RawISPInfo,
+		SourceIP:       server.SourceIP,
+		Interface:      opts.ClientOptions.Interface,
+	}
+	if opts.Privacy {
+		report.Client = report.Client.Redact()
+	}
 
 	log.Info("Ping and Jitter test started")
-	if report.Ping, report.Jitter, err = server.ICMPPingAndJitter(pingCount); err != nil {
-		return nil, err
+	server.Emit(defs.Event{Type: defs.EventPhaseStarted, Phase: defs.PhasePing})
+	if report.Ping, report.Jitter, err = server.ICMPPingAndJitter(ctx, opts.PingCount); err != nil {
+		return nil, phaseFailed(server, defs.PhasePing, err)
+	}
+	server.Emit(defs.Event{
+		Type:   defs.EventPhaseFinished,
+		Phase:  defs.PhasePing,
+		Ping:   report.Ping,
+		Jitter: report.Jitter,
+	})
+	downloadOpts, uploadOpts := opts.transferOptions(), opts.transferOptions()
+	// the bidirectional test needs the parameters of both directions
+	tuneDownload := !opts.NoDownload || opts.Bidirectional
+	tuneUpload := !opts.NoUpload || opts.Bidirectional
+	if opts.AutoTune && (tuneDownload || tuneUpload) {
+		log.Info("Auto-tune started")
+		server.Emit(defs.Event{Type: defs.EventPhaseStarted, Phase: defs.PhaseTuning})
+		tuning, err := AutoTune(ctx, server, TuneOptions{
+			NoDownload: !tuneDownload,
+			NoUpload:   !tuneUpload,
+			Transfer:   opts.transferOptions(),
+		})
+		if err != nil {
+			return nil, phaseFailed(server, defs.PhaseTuning, err)
+		}
+		report.Tuning = tuning
+		downloadOpts.Requests, downloadOpts.Chunks = tuning.DownloadRequests, tuning.Chunks
+		uploadOpts.Requests, uploadOpts.UploadSize = tuning.UploadRequests, tuning.UploadSize
+		server.Emit(defs.Event{Type: defs.EventPhaseFinished, Phase: defs.PhaseTuning, Tuning: tuning})
 	}
-	if !noDownload {
+	if !opts.NoDownload {
 		log.Info("Download test started")
-		if report.Download, report.BytesReceived, err = server.Download(requests, chunks, duration); err != nil {
-			return nil, err
+		server.Emit(defs.Event{Type: defs.EventPhaseStarted, Phase: defs.PhaseDownload})
+		result, err := server.ManualDownload(ctx, downloadOpts)
+		if err != nil {
+			return nil, phaseFailed(server, defs.PhaseDownload, err)
 		}
+		report.Download, report.BytesReceived = result.Mbps, result.Bytes
+		report.DownloadLatency = result.Latency
+		report.DownloadStats = result.Stats
+		report.DownloadDuration, report.DownloadConverged = result.Duration.Seconds(), result.Converged
+		server.Emit(defs.Event{
+			Type:    defs.EventPhaseFinished,
+			Phase:   defs.PhaseDownload,
+			Bytes:   result.Bytes,
+			Speed:   mbpsToBytes(result.Mbps),
+			Latency: result.Latency,
+		})
 	}
-	if !noUpload {
+	if !opts.NoUpload {
 		log.Info("Upload tests started")
-		if report.Upload, report.BytesSent, err = server.Upload(noPrealloc, requests, uploadSize, duration); err != nil {
-			return nil, err
+		server.Emit(defs.Event{Type: defs.EventPhaseStarted, Phase: defs.PhaseUpload})
+		result, err := server.ManualUpload(ctx, uploadOpts)
+		if err != nil {
+			return nil, phaseFailed(server, defs.PhaseUpload, err)
+		}
+		report.Upload, report.BytesSent = result.Mbps, result.Bytes
+		report.UploadLatency = result.Latency
+		report.UploadStats = result.Stats
+		report.UploadDuration, report.UploadConverged = result.Duration.Seconds(), result.Converged
+		server.Emit(defs.Event{
+			Type:    defs.EventPhaseFinished,
+			Phase:   defs.PhaseUpload,
+			Bytes:   result.Bytes,
+			Speed:   mbpsToBytes(result.Mbps),
+			Latency: result.Latency,
+		})
+	}
+	if opts.Bidirectional {
+		log.Info("Bidirectional test started")
+		server.Emit(defs.Event{Type: defs.EventPhaseStarted, Phase: defs.PhaseBidirectional})
+		result, err := server.ManualBidirectional(ctx, downloadOpts, uploadOpts)
+		if err != nil {
+			return nil, phaseFailed(server, defs.PhaseBidirectional, err)
 		}
+		report.Bidirectional = &defs.Bidirectional{
+			Download:      result.Download.Mbps,
+			Upload:        result.Upload.Mbps,
+			BytesReceived: result.Download.Bytes,
+			BytesSent:     result.Upload.Bytes,
+			Latency:       result.Latency,
+		}
+		server.Emit(defs.Event{
+			Type:          defs.EventPhaseFinished,
+			Phase:         defs.PhaseBidirectional,
+			Latency:       result.Latency,
+			Bidirectional: report.Bidirectional,
+		})
+	}
+	if opts.Responsiveness {
+		log.Info("Responsiveness test started")
+		server.Emit(defs.Event{Type: defs.EventPhaseStarted, Phase: defs.PhaseResponsiveness})
+		result, err := MeasureResponsiveness(ctx, server, opts.responsivenessOptions())
+		if err != nil {
+			return nil, phaseFailed(server, defs.PhaseResponsiveness, err)
+		}
+		report.Responsiveness = result
+		server.Emit(defs.Event{
+			Type:           defs.EventPhaseFinished,
+			Phase:          defs.PhaseResponsiveness,
+			Responsiveness: result,
+		})
 	}
+	var bidirectionalLatency *defs.LatencyStats
+	if report.Bidirectional != nil {
+		bidirectionalLatency = report.Bidirectional.Latency
+	}
+	report.Bufferbloat = defs.BufferbloatGrade(
+		report.Ping,
+		report.DownloadLatency,
+		report.UploadLatency,
+		bidirectionalLatency,
+	)
 	report.Timestamp = time.Now()
 
-	if !noShare {
-		var extra defs.TelemetryExtra
-		extra.ServerName = server.Name
-		extra.Extra = ""
-		telemetryServer := defs.TelemetryServer{
-			Level:  DefaultTelemetryLevel,
-			Server: DefaultTelemetryServer,
-			Path:   DefaultTelemetryPath,
-			Share:  DefaultTelemetryShare,
+	if !opts.NoShare && telemetryServer.Disabled() {
+		log.Warn("Telemetry is disabled, the results are not shared")
+	} else if !opts.NoShare {
+		extra := defs.TelemetryExtra{ServerName: server.Name, Extra: opts.TelemetryExtra}
+		shared, sharedISPInfo, sharedLog := &report, ispInfo, server.TLog
+		if opts.Privacy {
+			shared = &defs.Report{Download: report.Download, Upload: report.Upload}
+			sharedISPInfo, sharedLog = &defs.GetIPResult{}, defs.NewTelemetryLog(0)
 		}
 		log.Info("Sending telemetry information")
-		if link, err := SendTelemetry(telemetryServer, extra, ispInfo, &report, &server.TLog); err != nil {
+		if link, err := SendTelemetry(ctx, server.GetHTTPClient(), telemetryServer, extra, sharedISPInfo, shared, sharedLog); err != nil {
 			log.Errorf("Error when sending telemetry data: %s", err)
 		} else {
 			report.ShareLink = link
@@ -115,8 +377,108 @@ func SingleSpeedTest(
 	return &report, nil
 }
 
-// sendTelemetry sends the telemetry result to server, if --share is given
+// telemetryServer returns opts.Telemetry with its empty fields set to the defaults
+func (opts Options) telemetryServer() defs.TelemetryServer {
+	t := opts.Telemetry
+	if t.Level == "" {
+		t.Level = DefaultTelemetryLevel
+	}
+	if t.Server == "" {
+		t.Server = DefaultTelemetryServer
+	}
+	if t.Path == "" {
+		t.Path = DefaultTelemetryPath
+	}
+	if t.Share == "" {
+		t.Share = DefaultTelemetryShare
+	}
+	return t
+}
+
+// transferOptions returns the parameters of the download and upload tests
+func (opts Options) transferOptions() defs.TransferOptions {
+	return defs.TransferOptions{
+		Requests:        opts.Requests,
+		Chunks:          opts.Chunks,
+		UploadSize:      opts.UploadSize,
+		NoPrealloc:      opts.NoPrealloc,
+		Duration:        opts.Duration,
+		LatencyInterval: opts.LatencyInterval,
+		SampleInterval:  opts.SampleInterval,
+		Warmup:          opts.Warmup,
+		Aggregation:     opts.Aggregation,
+		EarlyStop:       opts.EarlyStop,
+	}
+}
+
+// responsivenessOptions returns the parameters of the responsiveness test
+func (opts Options) responsivenessOptions() ResponsivenessOptions {
+	return ResponsivenessOptions{
+		NoDownload: opts.NoDownload,
+		NoUpload:   opts.NoUpload,
+		Chunks:     opts.Chunks,
+		UploadSize: opts.UploadSize,
+	}
+}
+
+// runDualStack runs the test over IPv4 and then over IPv6 against the same server. A family that fails
+// is left out of the report, an error is only returned when both fail
+func runDualStack(ctx context.Context, server *defs.Server, opts Options) (*defs.Report, error) {
+	report := defs.Report{Server: *server}
+
+	var errs []error
+	for _, ipVersion := range []int{4, 6} {
+		familyOpts := opts
+		familyOpts.DualStack = false
+		familyOpts.Client = nil
+		familyOpts.ClientOptions.IPVersion = ipVersion
+
+		// every family gets its own copy, so a fallback to TCP ping in one doesn't affect the other
+		familyServer := *server
+		log.Infof("Starting the IPv%d test", ipVersion)
+		familyReport, err := Run(ctx, &familyServer, familyOpts)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			log.Warnf("IPv%d test failed: %s", ipVersion, err)
+			errs = append(errs, fmt.Errorf("IPv%d: %w", ipVersion, err))
+			continue
+		}
+
+		if ipVersion == 4 {
+			report.IPv4 = familyReport
+		} else {
+			report.IPv6 = familyReport
+		}
+		if report.Client.IP == "" {
+			report.Client = familyReport.Client
+		}
+	}
+
+	if len(errs) == 2 {
+		return nil, errors.Join(errs...)
+	}
+	report.Timestamp = time.Now()
+	return &report, nil
+}
+
+// phaseFailed emits an error event for the failed phase and returns the error
+func phaseFailed(server *defs.Server, phase defs.Phase, err error) error {
+	server.Emit(defs.Event{Type: defs.EventError, Phase: phase, Err: err})
+	return err
+}
+
+// mbpsToBytes converts a speed in Mbps to bytes/second
+func mbpsToBytes(mbps float64) float64 {
+	return mbps * 1000 * 1000 / 8
+}
+
+// sendTelemetry sends the telemetry result to server, if --share is given.
+// http.DefaultClient is used when client is nil
 func SendTelemetry(
+	ctx context.Context,
+	client *http.Client,
 	telemetryServer defs.TelemetryServer,
 	extra defs.TelemetryExtra,
 	ispInfo *defs.GetIPResult,
@@ -194,7 +556,7 @@ func SendTelemetry(
 		return "", err
 	}
 
-	req, err := http.NewRequest(http.MethodPost, telemetryUrl.String(), &buf)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, telemetryUrl.String(), &buf)
 	if err != nil {
 		log.Debugf("Error when creating HTTP request: %s", err)
 		return "", err
@@ -202,7 +564,10 @@ func SendTelemetry(
 	req.Header.Set("Content-Type", wr.FormDataContentType())
 	req.Header.Set("User-Agent", defs.UserAgent)
 
-	resp, err := http.DefaultClient.Do(req)
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		log.Debugf("Error when making HTTP request: %s", err)
 		return "", err
@@ -1,13 +1,16 @@
 package speedtest
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
-	"sync"
+	"regexp"
+	"sort"
+	"strings"
 
 	"github.com/czechbol/librespeedtest/defs"
 	log "github.com/sirupsen/logrus"
@@ -24,41 +27,65 @@ const (
 	DefaultTelemetryShare  = "/results/"
 )
 
-type PingJob struct {
-	Index  int
-	Server defs.Server
+// FetchServerList fetches a server list from a URL, http.DefaultClient is used when client is nil
+func FetchServerList(ctx context.Context, client *http.Client, listURL string) (*[]defs.Server, error) {
+	return fetchServerList(ctx, client, listURL, ParseServerList)
 }
 
-type PingResult struct {
-	Index int
-	Ping  float64
-}
-
-// FetchServerList fetches a server list from a URL
-func FetchServerList(listURL string) (*[]defs.Server, error) {
+// fetchServerList fetches a server list from a URL and decodes it with parse
+func fetchServerList(
+	ctx context.Context,
+	client *http.Client,
+	listURL string,
+	parse func([]byte) ([]defs.Server, error),
+) (*[]defs.Server, error) {
 	// getting the server list from remote
-	var servers []defs.Server
-	req, err := http.NewRequest(http.MethodGet, listURL, nil)
+	resp, b, err := requestServerList(ctx, client, listURL, nil)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("User-Agent", defs.UserAgent)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching the server list failed with status %s", resp.Status)
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	servers, err := parse(b)
 	if err != nil {
 		return nil, err
 	}
+	return &servers, nil
+}
 
-	b, err := ioutil.ReadAll(resp.Body)
+// requestServerList requests the server list at listURL with the given extra headers,
+// and returns the response together with its body
+func requestServerList(
+	ctx context.Context,
+	client *http.Client,
+	listURL string,
+	header http.Header,
+) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, listURL, nil)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("User-Agent", defs.UserAgent)
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
 
-	if err := json.Unmarshal(b, &servers); err != nil {
-		return nil, err
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
 	}
-	return &servers, nil
+	return resp, b, nil
 }
 
 // GetLocalServerList reads a server list from a filesystem path
@@ -71,18 +98,133 @@ func GetLocalServerList(listPath string) (*[]defs.Server, error) {
 
 	defer f.Close()
 
-	var servers []defs.Server
-
 	b, err := ioutil.ReadAll(f)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := json.Unmarshal(b, &servers); err != nil {
+	servers, err := ParseServerList(b)
+	if err != nil {
 		return nil, err
 	}
+	return &servers, nil
+}
+
+// LoadServerList reads a server list from a URL when source starts with http:// or https://,
+// and from a filesystem path otherwise
+func LoadServerList(ctx context.Context, client *http.Client, source string) (*[]defs.Server, error) {
+	if isRemoteList(source) {
+		return FetchServerList(ctx, client, source)
+	}
+	return GetLocalServerList(source)
+}
+
+// isRemoteList reports whether the server list source is a URL
+func isRemoteList(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
 
-	return &servers, err
+// ParseServerList decodes a JSON server list, an entry that doesn't describe a usable server
+// is an error naming the entry
+func ParseServerList(data []byte) ([]defs.Server, error) {
+	return parseServerList(data, nil)
+}
+
+// ParseServerListSkipInvalid decodes a JSON server list like ParseServerList, but leaves out the
+// entries that don't describe a usable server with a warning. It is meant for the lists the user
+// doesn't control, like the public one, where a single broken entry shouldn't take down the rest
+func ParseServerListSkipInvalid(data []byte) ([]defs.Server, error) {
+	return parseServerList(data, func(err error) {
+		log.Warnf("Skipping %s", err)
+	})
+}
+
+// parseServerList decodes a JSON server list. The entries that don't describe a usable server
+// are passed to skip and left out, or fail the whole list when skip is nil
+func parseServerList(data []byte, skip func(error)) ([]defs.Server, error) {
+	var entries []json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("server list is not a JSON array: %w", err)
+	}
+
+	servers := make([]defs.Server, 0, len(entries))
+	for i, entry := range entries {
+		server, err := parseServerEntry(i, entry)
+		if err != nil {
+			if skip == nil {
+				return nil, err
+			}
+			skip(err)
+			continue
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// parseServerEntry decodes the i-th entry of a server list and checks that it describes a usable server
+func parseServerEntry(i int, entry json.RawMessage) (defs.Server, error) {
+	var server defs.Server
+	if err := json.Unmarshal(entry, &server); err != nil {
+		return server, fmt.Errorf("server list entry %d: %w", i, err)
+	}
+
+	var missing []string
+	for field, value := range map[string]string{
+		"server":  server.Server,
+		"dlURL":   server.DownloadURL,
+		"ulURL":   server.UploadURL,
+		"pingURL": server.PingURL,
+	} {
+		if value == "" {
+			missing = append(missing, field)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return server, fmt.Errorf(
+			"server list entry %d (id %d, %q): missing %s",
+			i, server.ID, server.Name, strings.Join(missing, ", "),
+		)
+	}
+	if _, err := server.GetURL(); err != nil {
+		return server, fmt.Errorf("server list entry %d (id %d, %q): %w", i, server.ID, server.Name, err)
+	}
+	return server, nil
+}
+
+// MergeServerLists concatenates the server lists, leaving out the servers whose ID or URL
+// appeared in an earlier entry. Servers without an ID are only compared by URL, the URL scheme
+// is ignored
+func MergeServerLists(lists ...[]defs.Server) []defs.Server {
+	seenIDs := make(map[int]bool)
+	seenURLs := make(map[string]bool)
+
+	var merged []defs.Server
+	for _, list := range lists {
+		for _, server := range list {
+			key := serverKey(server)
+			if (server.ID != 0 && seenIDs[server.ID]) || seenURLs[key] {
+				log.Debugf("Skipping duplicate server %d (%s)", server.ID, server.Server)
+				continue
+			}
+			if server.ID != 0 {
+				seenIDs[server.ID] = true
+			}
+			seenURLs[key] = true
+			merged = append(merged, server)
+		}
+	}
+	return merged
+}
+
+// serverKey identifies the server by its URL without the scheme
+func serverKey(server defs.Server) string {
+	u, err := server.GetURL()
+	if err != nil {
+		return server.Server
+	}
+	return u.Host + strings.TrimSuffix(u.Path, "/")
 }
 
 // PreprocessServers sets a few key attributes of the servers
@@ -115,97 +257,55 @@ func PreprocessServers(
 	return nil
 }
 
-// RankServer performs a ping request to each server frin the given slice and
-// returns the fastest one
-func RankServers(servers *[]defs.Server) (defs.Server, error) {
-	var wg sync.WaitGroup
-	jobs := make(chan PingJob, len(*servers))
-	results := make(chan PingResult, len(*servers))
-	done := make(chan struct{})
-
-	pingList := make(map[int]float64)
-
-	// spawn concurrent pingers
-	for i := 0; i < len(*servers); i++ {
-		go pingWorker(jobs, results, &wg)
-	}
-	// send ping jobs to workers
-	for idx, server := range *servers {
-		wg.Add(1)
-		jobs <- PingJob{Index: idx, Server: server}
-	}
-
-	go func() {
-		wg.Wait()
-		close(done)
-	}()
-
-Loop:
-	for {
-		select {
-		case result := <-results:
-			pingList[result.Index] = result.Ping
-		case <-done:
-			break Loop
-		}
-	}
+// ServerFilter describes the servers kept by FilterServers, a zero value keeps them all
+type ServerFilter struct {
+	// IDs keeps only the servers with these IDs
+	IDs []int
+	// Exclude removes the servers with these IDs
+	Exclude []int
+	// Name keeps only the servers whose name matches
+	Name *regexp.Regexp
+	// Sponsor keeps only the servers whose sponsor name matches
+	Sponsor *regexp.Regexp
+}
 
-	if len(pingList) == 0 {
-		return defs.Server{}, errors.New(
-			"No server is currently available, please try again later.",
-		)
+// FilterServers returns the servers matching the filter, it is an error when none does
+func FilterServers(servers []defs.Server, filter ServerFilter) ([]defs.Server, error) {
+	wanted := make(map[int]bool)
+	for _, id := range filter.IDs {
+		wanted[id] = true
 	}
-
-	// get the fastest server's index in the `servers` array
-	var serverIdx int
-	for idx, ping := range pingList {
-		if ping > 0 && ping <= pingList[serverIdx] {
-			serverIdx = idx
-		}
+	excluded := make(map[int]bool)
+	for _, id := range filter.Exclude {
+		excluded[id] = true
 	}
-	return (*servers)[serverIdx], nil
-}
 
-func pingWorker(
-	jobs <-chan PingJob,
-	results chan<- PingResult,
-	wg *sync.WaitGroup,
-) {
-	for {
-		job := <-jobs
-		server := job.Server
-		// get the URL of the speed test server from the JSON
-		u, err := server.GetURL()
-		if err != nil {
-			log.Debugf(
-				"Server URL is invalid for %s (%s), skipping",
-				server.Name,
-				server.Server,
-			)
-			wg.Done()
-			return
+	var filtered []defs.Server
+	found := make(map[int]bool)
+	for _, server := range servers {
+		found[server.ID] = true
+		if len(wanted) > 0 && !wanted[server.ID] {
+			continue
+		}
+		if excluded[server.ID] {
+			continue
+		}
+		if filter.Name != nil && !filter.Name.MatchString(server.Name) {
+			continue
 		}
+		if filter.Sponsor != nil && !filter.Sponsor.MatchString(server.SponsorName) {
+			continue
+		}
+		filtered = append(filtered, server)
+	}
 
-		// check the server is up by accessing the ping URL and checking its returned value == empty and status code == 200
-		if server.IsUp() {
-
-			// if server is up, get ping
-			ping, _, err := server.ICMPPingAndJitter(1)
-			if err != nil {
-				log.Debugf(
-					"Can't ping server %s (%s), skipping",
-					server.Name,
-					u.Hostname(),
-				)
-				wg.Done()
-				return
-			}
-			// return result
-			results <- PingResult{Index: job.Index, Ping: ping}
-			wg.Done()
-		} else {
-			log.Debugf("Server %s (%s) doesn't seem to be up, skipping", server.Name, u.Hostname())
-			wg.Done()
+	for _, id := range filter.IDs {
+		if !found[id] {
+			log.Warnf("Server %d is not in the server list", id)
 		}
 	}
+	if len(filtered) == 0 {
+		return nil, errors.New("no server matches the given filters")
+	}
+	return filtered, nil
 }
@@ -0,0 +1,140 @@
+package speedtest
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/czechbol/librespeedtest/defs"
+)
+
+const validServerJSON = `{"id": 1, "name": "A", "server": "http://a.example/", "dlURL": "garbage.php", ` +
+	`"ulURL": "empty.php", "pingURL": "empty.php", "getIpURL": "getIP.php"}`
+
+const serverListJSON = `[
+	` + validServerJSON + `,
+	{"id": 2, "name": "B", "server": "http://b.example/", "ulURL": "empty.php", "pingURL": "empty.php"},
+	{"id": 3, "name": "C", "server": "http://c.example/", "dlURL": "garbage.php", "ulURL": "empty.php", "pingURL": "empty.php"},
+	{"id": "4", "name": "D"}
+]`
+
+func TestParseServerList(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		skip    bool
+		ids     []int
+		wantErr string
+	}{
+		{"valid", `[` + validServerJSON + `]`, false, []int{1}, ""},
+		{"missing fields", serverListJSON, false, nil, "server list entry 1 (id 2, \"B\"): missing dlURL"},
+		{"skip invalid", serverListJSON, true, []int{1, 3}, ""},
+		{"bad url", `[{"id": 5, "server": "http://%zz/", "dlURL": "a", "ulURL": "b", "pingURL": "c"}]`, false, nil, "entry 0 (id 5"},
+		{"skip bad url", `[{"id": 5, "server": "http://%zz/", "dlURL": "a", "ulURL": "b", "pingURL": "c"}]`, true, nil, ""},
+		{"not an array", `{"id": 1}`, true, nil, "not a JSON array"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parse := ParseServerList
+			if tt.skip {
+				parse = ParseServerListSkipInvalid
+			}
+			servers, err := parse([]byte(tt.data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := serverIDs(servers); !equalInts(got, tt.ids) {
+				t.Errorf("got servers %v, want %v", got, tt.ids)
+			}
+		})
+	}
+}
+
+func TestMergeServerLists(t *testing.T) {
+	tests := []struct {
+		name  string
+		lists [][]defs.Server
+		ids   []int
+	}{
+		{
+			"duplicate id",
+			[][]defs.Server{
+				{{ID: 1, Server: "http://a.example/"}},
+				{{ID: 1, Server: "http://b.example/"}, {ID: 2, Server: "http://c.example/"}},
+			},
+			[]int{1, 2},
+		},
+		{
+			"duplicate url ignoring the scheme",
+			[][]defs.Server{
+				{{ID: 1, Server: "http://a.example/speed/"}},
+				{{ID: 2, Server: "https://a.example/speed"}},
+			},
+			[]int{1},
+		},
+		{
+			"servers without an id",
+			[][]defs.Server{
+				{{Server: "http://a.example/"}, {Server: "http://b.example/"}},
+				{{Server: "https://a.example/"}},
+			},
+			[]int{0, 0},
+		},
+		{"empty", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := serverIDs(MergeServerLists(tt.lists...)); !equalInts(got, tt.ids) {
+				t.Errorf("got servers %v, want %v", got, tt.ids)
+			}
+		})
+	}
+}
+
+func TestFilterServers(t *testing.T) {
+	servers := []defs.Server{
+		{ID: 1, Name: "Prague, CZ", SponsorName: "Acme"},
+		{ID: 2, Name: "Brno, CZ", SponsorName: "Example"},
+		{ID: 3, Name: "Vienna, AT", SponsorName: "Acme"},
+	}
+
+	tests := []struct {
+		name    string
+		filter  ServerFilter
+		ids     []int
+		wantErr bool
+	}{
+		{"no filter", ServerFilter{}, []int{1, 2, 3}, false},
+		{"ids", ServerFilter{IDs: []int{3, 1, 9}}, []int{1, 3}, false},
+		{"exclude", ServerFilter{Exclude: []int{2}}, []int{1, 3}, false},
+		{"name", ServerFilter{Name: regexp.MustCompile(`(?i)cz$`)}, []int{1, 2}, false},
+		{"sponsor", ServerFilter{Sponsor: regexp.MustCompile(`Acme`)}, []int{1, 3}, false},
+		{"combined", ServerFilter{Exclude: []int{1}, Sponsor: regexp.MustCompile(`Acme`)}, []int{3}, false},
+		{"nothing matches", ServerFilter{IDs: []int{9}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filtered, err := FilterServers(servers, tt.filter)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got := serverIDs(filtered); !equalInts(got, tt.ids) {
+				t.Errorf("got servers %v, want %v", got, tt.ids)
+			}
+		})
+	}
+}
+
+func serverIDs(servers []defs.Server) []int {
+	var ids []int
+	for _, server := range servers {
+		ids = append(ids, server.ID)
+	}
+	return ids
+}